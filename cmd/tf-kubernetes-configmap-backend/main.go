@@ -17,19 +17,26 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	flag "github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apiserver/pkg/server"
 	"k8s.io/apiserver/pkg/server/options"
 
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/encryption"
 	tfhttp "github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/http"
 	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/kubernetes"
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/metrics"
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/storage"
 	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/version"
 )
 
@@ -46,8 +53,25 @@ var (
 			CertDirectory: "tf-kubernetes-configmap-backend/certificates",
 		},
 	}
-	compressState bool
-	minifyState   bool
+	compressState        bool
+	compression          string
+	compressionLevel     int
+	minifyState          bool
+	chunkSize            int
+	storageMode          string
+	historyLimit         int
+	historyMaxAge        time.Duration
+	skipStateChecks      bool
+	encryptionKeyFile    string
+	kmsEndpoint          string
+	kmsName              string
+	kmsTimeout           time.Duration
+	rotateEncryptionKeys bool
+	maxRequestSize       int64
+	lockMode             string
+	lockTTL              time.Duration
+	projectOutputs       bool
+	virtualResource      bool
 )
 
 func main() {
@@ -58,7 +82,47 @@ func main() {
 	delegatingAuthorizationOptions.AddFlags(flag.CommandLine)
 
 	flag.BoolVar(&compressState, "compress-state", false, "Enable compression of the stored Terraform state")
+	_ = flag.CommandLine.MarkDeprecated("compress-state", "use --compression=gzip instead")
+	flag.StringVar(&compression, "compression", storage.CompressionNone,
+		fmt.Sprintf("Compression algorithm used for stored Terraform state. One of: %s", strings.Join(storage.Compressions, ", ")))
+	flag.IntVar(&compressionLevel, "compression-level", 0,
+		"Compression level, specific to the compression algorithm (gzip: -2 for Huffman-only, -1 for gzip's default level or 1-9; zstd: 1-22). Zero uses the default level: 9 for gzip and zstd's default level for zstd")
 	flag.BoolVar(&minifyState, "minify-state", false, "Enable minification of stored Terraform state")
+	flag.IntVar(&chunkSize, "state-chunk-size", storage.DefaultChunkSize,
+		"Maximum number of bytes of stored Terraform state to keep in a single configmap before splitting it across multiple configmaps")
+	flag.StringVar(&storageMode, "storage-mode", storage.ResourceConfigMaps,
+		fmt.Sprintf("Kubernetes resource used to store Terraform state for paths without a storage mode prefix. One of: %s",
+			strings.Join(storage.Resources, ", ")))
+	flag.IntVar(&historyLimit, "state-history-limit", 0,
+		"Number of previous versions of each Terraform state to keep. Zero disables state history")
+	flag.DurationVar(&historyMaxAge, "state-history-max-age", 0,
+		"Maximum age of previous versions of Terraform state to keep. Zero keeps previous versions regardless of age")
+
+	flag.StringVar(&encryptionKeyFile, "encryption-key-file", "",
+		"Path to a file of keys used to encrypt stored Terraform state, one <key id>:<base64 encoded 32 byte key> per line. The first key is used to encrypt new state")
+	flag.StringVar(&kmsEndpoint, "encryption-kms-endpoint", "",
+		"Unix socket endpoint of a Kubernetes KMS plugin used to encrypt stored Terraform state, e.g. unix:///var/run/kms-plugin/socket.sock")
+	flag.StringVar(&kmsName, "encryption-kms-name", "kms",
+		"Name of the KMS plugin key. Changing the name causes state to be re-encrypted")
+	flag.DurationVar(&kmsTimeout, "encryption-kms-timeout", 3*time.Second, "Timeout for calls to the KMS plugin")
+	flag.BoolVar(&rotateEncryptionKeys, "rotate-encryption-keys", false,
+		"Re-encrypt all stored Terraform state that is not encrypted with the current encryption key, then exit")
+	flag.BoolVar(&skipStateChecks, "skip-state-checks", false,
+		"Allow writes of Terraform state with a different lineage or a lower serial than the stored state")
+	flag.StringVar(&lockMode, "lock-mode", storage.LockModeAnnotations,
+		fmt.Sprintf("How Terraform state locks are stored. One of: %s", strings.Join(storage.LockModes, ", ")))
+	flag.DurationVar(&lockTTL, "lock-ttl", storage.DefaultLockTTL,
+		"Duration after which a lock expires if it is not renewed by the lock holder. Only used with --lock-mode=lease")
+
+	flag.BoolVar(&projectOutputs, "project-outputs", false,
+		"Write the outputs of Terraform state to a configmap, and sensitive outputs to a secret, after every write of state")
+
+	flag.BoolVar(&virtualResource, "authorize-virtual-resource", false,
+		fmt.Sprintf("Authorize access to Terraform state against the virtual %s.%s resource rather than the resource storing the state",
+			tfhttp.VirtualResource, tfhttp.VirtualResourceGroup))
+
+	flag.Int64Var(&maxRequestSize, "max-request-size", 0,
+		"Maximum size in bytes of request bodies, e.g. written Terraform state. Larger requests are rejected. Zero allows requests of any size")
 
 	versionFlag := flag.Bool("version", false, "Print version information and quit")
 
@@ -69,19 +133,68 @@ func main() {
 		os.Exit(0)
 	}
 
-	authenticationClient, err := kubernetes.AuthenticationClientFromOptions(delegatingAuthenticationOptions)
+	authenticationClient, uncachedAuthenticationClient, err := kubernetes.AuthenticationClientFromOptions(
+		delegatingAuthenticationOptions)
 	if err != nil {
 		log.Fatalf("failed to create authentication client: %v", err)
 	}
 
-	authorizationClient, err := kubernetes.AuthorizationClientFromOptions(delegatingAuthorizationOptions)
+	authorizationClient, uncachedAuthorizationClient, err := kubernetes.AuthorizationClientFromOptions(
+		delegatingAuthorizationOptions)
 	if err != nil {
 		log.Fatalf("failed to create authorization client: %v", err)
 	}
 
-	coreClient, err := kubernetes.CoreClient(kubeconfig)
+	client, err := kubernetes.Client(kubeconfig)
+	if err != nil {
+		log.Fatalf("failed to create client: %v", err)
+	}
+
+	if compressState && compression == storage.CompressionNone {
+		compression = storage.CompressionGzip
+	}
+	if !contains(storage.Compressions, compression) {
+		log.Fatalf("invalid compression %q, must be one of: %s", compression, strings.Join(storage.Compressions, ", "))
+	}
+
+	keyProvider, err := encryptionKeyProvider()
+	if err != nil {
+		log.Fatalf("failed to create encryption key provider: %v", err)
+	}
+
+	// The store for the default storage mode must be first as it is used for paths without a storage mode prefix.
+	storageOptions := storage.Options{
+		Compression:      compression,
+		CompressionLevel: compressionLevel,
+		Minify:           minifyState,
+		ChunkSize:        chunkSize,
+		HistoryLimit:     historyLimit,
+		HistoryMaxAge:    historyMaxAge,
+		KeyProvider:      keyProvider,
+		SkipStateChecks:  skipStateChecks,
+		LockMode:         lockMode,
+		LockTTL:          lockTTL,
+		ProjectOutputs:   projectOutputs,
+	}
+	defaultStore, err := storage.NewKubernetesStore(client, storageMode, storageOptions)
 	if err != nil {
-		log.Fatalf("failed to create core client: %v", err)
+		log.Fatalf("failed to create %s store: %v", storageMode, err)
+	}
+	stores := []storage.StateStore{defaultStore}
+	for _, resource := range storage.Resources {
+		if resource == storageMode {
+			continue
+		}
+		store, err := storage.NewKubernetesStore(client, resource, storageOptions)
+		if err != nil {
+			log.Fatalf("failed to create %s store: %v", resource, err)
+		}
+		stores = append(stores, store)
+	}
+
+	if rotateEncryptionKeys {
+		rotateKeys(stores)
+		return
 	}
 
 	if err := secureServingOptions.MaybeDefaultWithSelfSignedCerts("localhost", nil, []net.IP{net.ParseIP("127.0.0.1")}); err != nil {
@@ -92,9 +205,32 @@ func main() {
 		log.Fatalf("failed to initialize secure serving options: %v", err)
 	}
 
+	authenticator, err := kubernetes.AuthenticatorFromOptions(delegatingAuthenticationOptions, secureServingInfo, authenticationClient)
+	if err != nil {
+		log.Fatalf("failed to create authenticator: %v", err)
+	}
+
+	// Health endpoints are registered before the Terraform handler, which requires authentication for all paths. The
+	// checks use uncached clients, as cached reviews would report the API server as reachable after it has gone away.
+	healthHandler := tfhttp.NewHealthHandler([]tfhttp.HealthCheck{
+		{Name: "core", Check: kubernetes.ClientCheck(client)},
+		{Name: "tokenreview", Check: kubernetes.AuthenticationClientCheck(uncachedAuthenticationClient)},
+		{Name: "subjectaccessreview", Check: kubernetes.AuthorizationClientCheck(uncachedAuthorizationClient)},
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", healthHandler)
+	mux.Handle("/livez", healthHandler)
+	mux.Handle("/readyz", healthHandler)
+	metrics.Registry.MustRegister(tfhttp.NewLockCollector(stores))
+	mux.Handle("/metrics", tfhttp.NewMetricsHandler(metrics.Handler(), authenticator, authorizationClient))
+	mux.Handle("/", tfhttp.NewHandler(stores, authenticator, authorizationClient, tfhttp.Options{
+		MaxRequestSize:  maxRequestSize,
+		VirtualResource: virtualResource,
+	}))
+
 	internalStopCh := make(chan struct{})
 	stoppedCh, err := secureServingInfo.Serve(
-		tfhttp.NewHandler(coreClient, authenticationClient, authorizationClient, compressState, minifyState),
+		mux,
 		time.Duration(60)*time.Second,
 		internalStopCh,
 	)
@@ -112,3 +248,46 @@ func main() {
 
 	<-stoppedCh
 }
+
+// encryptionKeyProvider returns the configured encryption key provider, or nil if encryption is not enabled.
+func encryptionKeyProvider() (encryption.KeyProvider, error) {
+	switch {
+	case encryptionKeyFile != "" && kmsEndpoint != "":
+		return nil, errors.New("only one of --encryption-key-file and --encryption-kms-endpoint can be specified")
+	case encryptionKeyFile != "":
+		return encryption.NewLocalKeyProvider(encryptionKeyFile)
+	case kmsEndpoint != "":
+		return encryption.NewKMSKeyProvider(kmsName, kmsEndpoint, kmsTimeout)
+	default:
+		return nil, nil
+	}
+}
+
+// rotateKeys re-encrypts all state stored in all stores with the current encryption key.
+func rotateKeys(stores []storage.StateStore) {
+	failed := false
+	for _, store := range stores {
+		rotator, ok := store.(storage.KeyRotator)
+		if !ok {
+			continue
+		}
+		rotated, err := rotator.RotateEncryptionKeys(metav1.NamespaceAll)
+		log.Printf("re-encrypted %d %s", rotated, store.Resource())
+		if err != nil {
+			log.Printf("failed to re-encrypt %s: %v", store.Resource(), err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
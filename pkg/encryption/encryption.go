@@ -0,0 +1,305 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package encryption implements envelope encryption of stored Terraform state. Every state is encrypted with a new
+// random AES-256-GCM data key, which is itself encrypted by a KeyProvider and stored alongside the encrypted state.
+//
+// Encrypted state is split into fixed size segments that are encrypted independently, so that state can be encrypted
+// and decrypted as a stream without holding it all in memory. Each segment nonce includes the segment index and a
+// flag marking the final segment, so that segments cannot be reordered and truncation is detected.
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// magic prefixes all encrypted state, followed by the format version.
+	magic         = "tfstenc"
+	formatVersion = 1
+
+	dataKeySize     = 32
+	segmentSize     = 64 * 1024
+	noncePrefixSize = 7
+)
+
+// MagicSize is the number of bytes at the start of encrypted state that IsEncrypted requires.
+const MagicSize = len(magic)
+
+// KeyProvider encrypts and decrypts the data keys used to encrypt state.
+type KeyProvider interface {
+	// KeyID returns the ID of the key used to encrypt new data keys.
+	KeyID() string
+	// EncryptKey encrypts a data key with the current key.
+	EncryptKey(dataKey []byte) ([]byte, error)
+	// DecryptKey decrypts a data key that was encrypted with the identified key.
+	DecryptKey(keyID string, encryptedKey []byte) ([]byte, error)
+}
+
+// IsEncrypted returns true if data starts with the header of encrypted state.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(magic))
+}
+
+// KeyIDOf returns the ID of the key that encrypted the data key of the encrypted state, which may be truncated after
+// the encryption header.
+func KeyIDOf(data []byte) (string, error) {
+	h, err := readHeader(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	return h.keyID, nil
+}
+
+// header precedes the encrypted segments of encrypted state.
+type header struct {
+	keyID        string
+	encryptedKey []byte
+	noncePrefix  []byte
+}
+
+func (h *header) write(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	buf.WriteByte(formatVersion)
+	for _, field := range [][]byte{[]byte(h.keyID), h.encryptedKey} {
+		if len(field) > 0xffff {
+			return fmt.Errorf("encryption header field too long: %d bytes", len(field))
+		}
+		_ = binary.Write(&buf, binary.BigEndian, uint16(len(field)))
+		buf.Write(field)
+	}
+	buf.Write(h.noncePrefix)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func readHeader(r io.Reader) (*header, error) {
+	prefix := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(r, prefix); err != nil || string(prefix[:len(magic)]) != magic {
+		return nil, errors.New("state is not encrypted")
+	}
+	if prefix[len(magic)] != formatVersion {
+		return nil, fmt.Errorf("unsupported encryption format version %d", prefix[len(magic)])
+	}
+
+	var fields [2][]byte
+	for i := range fields {
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return nil, fmt.Errorf("invalid encryption header: %v", err)
+		}
+		fields[i] = make([]byte, length)
+		if _, err := io.ReadFull(r, fields[i]); err != nil {
+			return nil, fmt.Errorf("invalid encryption header: %v", err)
+		}
+	}
+	h := &header{keyID: string(fields[0]), encryptedKey: fields[1], noncePrefix: make([]byte, noncePrefixSize)}
+	if _, err := io.ReadFull(r, h.noncePrefix); err != nil {
+		return nil, fmt.Errorf("invalid encryption header: %v", err)
+	}
+	return h, nil
+}
+
+func segmentNonce(prefix []byte, index uint32, final bool) []byte {
+	nonce := make([]byte, 0, noncePrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = append(nonce, byte(index>>24), byte(index>>16), byte(index>>8), byte(index))
+	if final {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	index   uint32
+	buf     []byte
+	sealed  []byte
+	closed  bool
+	started bool
+	header  *header
+}
+
+// NewWriter returns a writer that encrypts state written to it with a new data key encrypted by the provider. The
+// writer must be closed to write the final segment.
+func NewWriter(w io.Writer, provider KeyProvider) (io.WriteCloser, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	encryptedKey, err := provider.EncryptKey(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt data key: %v", err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	noncePrefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(noncePrefix); err != nil {
+		return nil, err
+	}
+
+	return &writer{
+		w:      w,
+		aead:   aead,
+		prefix: noncePrefix,
+		buf:    make([]byte, 0, segmentSize),
+		header: &header{keyID: provider.KeyID(), encryptedKey: encryptedKey, noncePrefix: noncePrefix},
+	}, nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed encryption writer")
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full segment is only sealed once more data arrives, as the final segment must be marked as such.
+		if len(w.buf) == segmentSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):segmentSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *writer) seal(final bool) error {
+	if !w.started {
+		if err := w.header.write(w.w); err != nil {
+			return err
+		}
+		w.started = true
+	}
+	w.sealed = w.aead.Seal(w.sealed[:0], segmentNonce(w.prefix, w.index, final), w.buf, nil)
+	if _, err := w.w.Write(w.sealed); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+	w.index++
+	return nil
+}
+
+// Close writes the final segment. It does not close the underlying writer.
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+type reader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	index   uint32
+	segment []byte
+	plain   []byte
+	done    bool
+}
+
+// NewReader returns a reader that decrypts encrypted state, using the provider to decrypt the data key. An error is
+// returned by Read if the encrypted state has been modified or truncated.
+func NewReader(r io.Reader, provider KeyProvider) (io.Reader, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if provider == nil {
+		return nil, errors.New("state is encrypted but no encryption key provider is configured")
+	}
+	dataKey, err := provider.DecryptKey(h.keyID, h.encryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key with key %q: %v", h.keyID, err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &reader{
+		r:       bufio.NewReader(r),
+		aead:    aead,
+		prefix:  h.noncePrefix,
+		segment: make([]byte, segmentSize+aead.Overhead()),
+	}, nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next segment.
+func (r *reader) open() error {
+	n, err := io.ReadFull(r.r, r.segment)
+	final := false
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		final = true
+	case err != nil:
+		return err
+	default:
+		if _, err := r.r.Peek(1); err == io.EOF {
+			final = true
+		}
+	}
+	if n < r.aead.Overhead() {
+		return errors.New("encrypted state is truncated")
+	}
+
+	plain, err := r.aead.Open(r.segment[:0], segmentNonce(r.prefix, r.index, final), r.segment[:n], nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt state segment %d: %v", r.index, err)
+	}
+	r.plain = plain
+	r.index++
+	r.done = final
+	return nil
+}
@@ -0,0 +1,323 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tagSize is the size of the authentication tag appended to each encrypted segment.
+const tagSize = 16
+
+// testKeyLine returns a line of a local key file holding a new random key with the specified ID.
+func testKeyLine(t *testing.T, keyID string) string {
+	t.Helper()
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%s:%s\n", keyID, base64.StdEncoding.EncodeToString(key))
+}
+
+// testProvider returns a local key provider holding the keys of the specified key file lines.
+func testProvider(t *testing.T, lines ...string) KeyProvider {
+	t.Helper()
+	provider, err := parseLocalKeys(strings.NewReader(strings.Join(lines, "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+// testPlaintext returns n random bytes.
+func testPlaintext(t *testing.T, n int) []byte {
+	t.Helper()
+	plaintext := make([]byte, n)
+	if _, err := rand.Read(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	return plaintext
+}
+
+func encrypt(t *testing.T, plaintext []byte, provider KeyProvider) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(ciphertext []byte, provider KeyProvider) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(ciphertext), provider)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// headerSize returns the size of the header of the encrypted state.
+func headerSize(t *testing.T, ciphertext []byte) int {
+	t.Helper()
+	r := bytes.NewReader(ciphertext)
+	if _, err := readHeader(r); err != nil {
+		t.Fatal(err)
+	}
+	return len(ciphertext) - r.Len()
+}
+
+func TestRoundTrip(t *testing.T) {
+	provider := testProvider(t, testKeyLine(t, "key"))
+	for _, size := range []int{
+		0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 2 * segmentSize, 3*segmentSize + 7,
+	} {
+		plaintext := testPlaintext(t, size)
+		ciphertext := encrypt(t, plaintext, provider)
+		if !IsEncrypted(ciphertext) {
+			t.Errorf("%d bytes: expected encrypted state", size)
+		}
+		if keyID, err := KeyIDOf(ciphertext); err != nil || keyID != "key" {
+			t.Errorf("%d bytes: expected key ID %q, got %q (%v)", size, "key", keyID, err)
+		}
+
+		// Plaintext that exactly fills the last segment is written as a full final segment, without an empty segment.
+		segments := size/segmentSize + 1
+		if size > 0 && size%segmentSize == 0 {
+			segments--
+		}
+		if want := headerSize(t, ciphertext) + size + segments*tagSize; len(ciphertext) != want {
+			t.Errorf("%d bytes: expected %d segments in %d bytes, got %d bytes", size, segments, want, len(ciphertext))
+		}
+
+		decrypted, err := decrypt(ciphertext, provider)
+		if err != nil {
+			t.Errorf("%d bytes: failed to decrypt: %v", size, err)
+			continue
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("%d bytes: decrypted state does not match, got %d bytes", size, len(decrypted))
+		}
+	}
+}
+
+func TestWriteInPieces(t *testing.T) {
+	provider := testProvider(t, testKeyLine(t, "key"))
+	plaintext := testPlaintext(t, 2*segmentSize)
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for remaining := plaintext; len(remaining) > 0; {
+		n := 1000
+		if n > len(remaining) {
+			n = len(remaining)
+		}
+		if _, err := w.Write(remaining[:n]); err != nil {
+			t.Fatal(err)
+		}
+		remaining = remaining[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("more")); err == nil {
+		t.Error("expected write to closed writer to fail")
+	}
+	decrypted, err := decrypt(buf.Bytes(), provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Error("decrypted state does not match")
+	}
+}
+
+// segments splits encrypted state into its header and encrypted segments.
+func segments(t *testing.T, ciphertext []byte) ([]byte, [][]byte) {
+	t.Helper()
+	n := headerSize(t, ciphertext)
+	header, rest := ciphertext[:n], ciphertext[n:]
+	var segments [][]byte
+	for len(rest) > 0 {
+		n := segmentSize + tagSize
+		if n > len(rest) {
+			n = len(rest)
+		}
+		segments = append(segments, rest[:n])
+		rest = rest[n:]
+	}
+	return header, segments
+}
+
+func join(header []byte, segments ...[]byte) []byte {
+	return bytes.Join(append([][]byte{header}, segments...), nil)
+}
+
+func TestTamperedState(t *testing.T) {
+	provider := testProvider(t, testKeyLine(t, "key"))
+	plaintext := testPlaintext(t, 2*segmentSize+100)
+	ciphertext := encrypt(t, plaintext, provider)
+	header, s := segments(t, ciphertext)
+	if len(s) != 3 {
+		t.Fatalf("expected 3 segments, got %d", len(s))
+	}
+	flipped := append([]byte(nil), ciphertext...)
+	flipped[len(header)+10] ^= 1
+
+	for _, c := range []struct {
+		name       string
+		ciphertext []byte
+	}{
+		{name: "truncated at segment boundary", ciphertext: join(header, s[0], s[1])},
+		{name: "truncated after first segment", ciphertext: join(header, s[0])},
+		{name: "truncated after header", ciphertext: header},
+		{name: "truncated within segment", ciphertext: ciphertext[:len(ciphertext)-1]},
+		{name: "final segment dropped and reordered", ciphertext: join(header, s[1], s[0])},
+		{name: "segments reordered", ciphertext: join(header, s[1], s[0], s[2])},
+		{name: "segment duplicated", ciphertext: join(header, s[0], s[0], s[1], s[2])},
+		{name: "segment modified", ciphertext: flipped},
+	} {
+		if _, err := decrypt(c.ciphertext, provider); err == nil {
+			t.Errorf("%s: expected decryption to fail", c.name)
+		}
+	}
+
+	// Truncation within the header is detected before any key is used.
+	if _, err := decrypt(header[:len(header)-1], provider); err == nil || !strings.Contains(err.Error(), "header") {
+		t.Errorf("expected invalid header error, got %v", err)
+	}
+	if _, err := decrypt([]byte("{}"), provider); err == nil {
+		t.Error("expected decryption of unencrypted state to fail")
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	key := testKeyLine(t, "key")
+	provider := testProvider(t, key)
+	ciphertext := encrypt(t, testPlaintext(t, 100), provider)
+
+	for _, c := range []struct {
+		name     string
+		provider KeyProvider
+		err      string
+	}{
+		{name: "no provider", err: "no encryption key provider"},
+		{name: "unknown key ID", provider: testProvider(t, testKeyLine(t, "other")), err: `unknown encryption key "key"`},
+		{
+			name:     "wrong key",
+			provider: testProvider(t, testKeyLine(t, "key")),
+			err:      `failed to decrypt data key with key "key"`,
+		},
+	} {
+		_, err := decrypt(ciphertext, c.provider)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected error containing %q, got %v", c.name, c.err, err)
+		}
+	}
+
+	// The key ID is authenticated, so a data key cannot be decrypted with a key stored under a different ID.
+	encryptedKey, err := provider.EncryptKey(make([]byte, dataKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	renamed := testProvider(t, "renamed:"+strings.SplitN(key, ":", 2)[1])
+	if _, err := renamed.DecryptKey("renamed", encryptedKey); err == nil {
+		t.Error("expected data key to be bound to its key ID")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys")
+
+	oldKey := testKeyLine(t, "old")
+	if err := ioutil.WriteFile(path, []byte("# keys\n"+oldKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+	provider, err := NewLocalKeyProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := testPlaintext(t, segmentSize+1)
+	oldCiphertext := encrypt(t, plaintext, provider)
+
+	// Keys are rotated by adding a new key to the top of the file.
+	if err := ioutil.WriteFile(path, []byte(testKeyLine(t, "new")+oldKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := NewLocalKeyProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.KeyID() != "new" {
+		t.Errorf("expected new key to be current, got %q", rotated.KeyID())
+	}
+	decrypted, err := decrypt(oldCiphertext, rotated)
+	if err != nil {
+		t.Fatalf("failed to decrypt state encrypted with previous key: %v", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Error("decrypted state does not match")
+	}
+
+	newCiphertext := encrypt(t, plaintext, rotated)
+	if keyID, err := KeyIDOf(newCiphertext); err != nil || keyID != "new" {
+		t.Errorf("expected state to be encrypted with new key, got %q (%v)", keyID, err)
+	}
+	if _, err := decrypt(newCiphertext, provider); err == nil {
+		t.Error("expected state encrypted with new key to need the new key")
+	}
+}
+
+func TestParseLocalKeys(t *testing.T) {
+	key := testKeyLine(t, "key")
+	for _, c := range []struct {
+		name string
+		keys string
+		err  string
+	}{
+		{name: "empty", keys: "# no keys\n\n", err: "no encryption keys found"},
+		{name: "missing ID", keys: ":" + strings.SplitN(key, ":", 2)[1], err: "line 1"},
+		{name: "invalid base64", keys: "key:!!!\n", err: `invalid encryption key "key"`},
+		{name: "short key", keys: "key:" + base64.StdEncoding.EncodeToString(make([]byte, 16)), err: "expected 32 bytes"},
+		{name: "duplicate", keys: key + key, err: `duplicate encryption key "key"`},
+	} {
+		if _, err := parseLocalKeys(strings.NewReader(c.keys)); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected error containing %q, got %v", c.name, c.err, err)
+		}
+	}
+}
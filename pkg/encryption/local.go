@@ -0,0 +1,115 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package encryption
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// localKeyProvider encrypts data keys with AES-256-GCM keys read from a local file.
+type localKeyProvider struct {
+	currentKeyID string
+	keys         map[string][]byte
+}
+
+// NewLocalKeyProvider returns a KeyProvider that encrypts data keys with keys read from a file. Each non-empty line
+// of the file that does not start with # is a key in the form <key id>:<base64 encoded 32 byte key>. The first key
+// is used to encrypt new data keys, while all keys can be used to decrypt data keys, so keys are rotated by adding a
+// new key to the top of the file.
+func NewLocalKeyProvider(path string) (KeyProvider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open encryption key file: %v", err)
+	}
+	defer f.Close()
+	return parseLocalKeys(f)
+}
+
+func parseLocalKeys(r io.Reader) (*localKeyProvider, error) {
+	p := &localKeyProvider{keys: map[string][]byte{}}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid encryption key on line %d: expected <key id>:<base64 encoded key>", line)
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %q: %v", parts[0], err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("invalid encryption key %q: expected 32 bytes, got %d", parts[0], len(key))
+		}
+		if _, duplicate := p.keys[parts[0]]; duplicate {
+			return nil, fmt.Errorf("duplicate encryption key %q", parts[0])
+		}
+		if p.currentKeyID == "" {
+			p.currentKeyID = parts[0]
+		}
+		p.keys[parts[0]] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read encryption key file: %v", err)
+	}
+	if p.currentKeyID == "" {
+		return nil, errors.New("no encryption keys found")
+	}
+	return p, nil
+}
+
+func (p *localKeyProvider) KeyID() string {
+	return p.currentKeyID
+}
+
+func (p *localKeyProvider) EncryptKey(dataKey []byte) ([]byte, error) {
+	aead, err := newGCM(p.keys[p.currentKeyID])
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, []byte(p.currentKeyID)), nil
+}
+
+func (p *localKeyProvider) DecryptKey(keyID string, encryptedKey []byte) ([]byte, error) {
+	key, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %q", keyID)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(encryptedKey) < aead.NonceSize() {
+		return nil, errors.New("encrypted data key is too short")
+	}
+	nonce, sealed := encryptedKey[:aead.NonceSize()], encryptedKey[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, []byte(keyID))
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	authorizationapi "k8s.io/api/authorization/v1"
+
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/storage"
+)
+
+const (
+	// VirtualResourceGroup is the API group of the virtual resource that access to state is authorized against when
+	// Options.VirtualResource is set. The group does not need to be served by the Kubernetes API server to be used in
+	// RBAC rules.
+	VirtualResourceGroup = "terraform.jimmidyson.github.com"
+	// VirtualResource is the virtual resource that access to state is authorized against when Options.VirtualResource
+	// is set.
+	VirtualResource = "states"
+)
+
+// resourceAttributes returns the attributes of a SubjectAccessReview for verb on the subresource of the state stored
+// in resource. Unless the virtual resource is used, locks are authorized as access to the object storing the state.
+func (h *handler) resourceAttributes(resource, subresource, verb string,
+	key storage.Key) *authorizationapi.ResourceAttributes {
+	group := ""
+	switch {
+	case h.options.VirtualResource:
+		group, resource = VirtualResourceGroup, VirtualResource
+	case subresource == subresourceLock:
+		subresource = ""
+	}
+	return &authorizationapi.ResourceAttributes{
+		Group:       group,
+		Resource:    resource,
+		Subresource: subresource,
+		Namespace:   key.Namespace,
+		Name:        key.Name,
+		Verb:        verb,
+	}
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	"strings"
+)
+
+// parseETags parses an If-Match or If-None-Match header, returning the unquoted entity tags, with "*" returned as is.
+// Weak entity tags are only returned if weak is true, as they never match using the strong comparison required by
+// If-Match. The result is not nil for a non-empty header, even if it contains no matching entity tags.
+func parseETags(header string, weak bool) []string {
+	if header == "" {
+		return nil
+	}
+	etags := []string{}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if tag != "*" {
+			if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+				continue
+			}
+			tag = tag[1 : len(tag)-1]
+		}
+		etags = append(etags, tag)
+	}
+	return etags
+}
+
+// notModified returns true if the If-None-Match header matches etag, using weak comparison.
+func notModified(header, etag string) bool {
+	for _, e := range parseETags(header, true) {
+		if e == "*" || e == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func quoteETag(etag string) string {
+	return `"` + etag + `"`
+}
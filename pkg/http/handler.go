@@ -17,125 +17,126 @@
 package http
 
 import (
-	"bytes"
-	"compress/gzip"
+	"crypto/md5"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"strings"
+	"strconv"
+	"time"
 
-	minifyjson "github.com/tdewolff/minify/v2/json"
 	authenticationapi "k8s.io/api/authentication/v1"
 	authorizationapi "k8s.io/api/authorization/v1"
-	v1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	authenticationv1 "k8s.io/client-go/kubernetes/typed/authentication/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
 	authorizationv1 "k8s.io/client-go/kubernetes/typed/authorization/v1"
-	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/metrics"
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/storage"
 )
 
 const (
 	MethodLock   = "LOCK"
 	MethodUnlock = "UNLOCK"
-
-	annotationKeyPrefix        = "tf-kubernetes-configmap-backend.jimmidyson.github.com/"
-	annotationKeyLockID        = annotationKeyPrefix + "lock-id"
-	annotationKeyLockOperation = annotationKeyPrefix + "lock-operation"
-	annotationKeyLockInfo      = annotationKeyPrefix + "lock-info"
-	annotationKeyLockWho       = annotationKeyPrefix + "lock-who"
 )
 
+// Options configures the handler.
+type Options struct {
+	// MaxRequestSize is the maximum size in bytes of request bodies, e.g. written state. Larger requests are rejected
+	// with 413 Request Entity Too Large. Zero allows requests of any size.
+	MaxRequestSize int64
+	// VirtualResource authorizes access to state against the states resource of the terraform.jimmidyson.github.com
+	// group, with lock and outputs subresources, rather than the resource storing the state. Users then need no access
+	// to the configmaps or secrets themselves.
+	VirtualResource bool
+}
+
 type handler struct {
-	coreClient           corev1.CoreV1Interface
-	authenticationClient authenticationv1.TokenReviewInterface
-	authorizationClient  authorizationv1.SubjectAccessReviewInterface
-	compressState        bool
-	minifyState          bool
+	stores              []storage.StateStore
+	authenticator       authenticator.Request
+	authorizationClient authorizationv1.SubjectAccessReviewInterface
+	options             Options
 }
 
+// NewHandler returns a handler implementing the Terraform http backend protocol. The first store is used for paths
+// that are not prefixed with the resource of one of the stores. Requests are recorded in metrics.
 func NewHandler(
-	coreClient corev1.CoreV1Interface,
-	authenticationClient authenticationv1.TokenReviewInterface,
+	stores []storage.StateStore,
+	authenticator authenticator.Request,
 	authorizationClient authorizationv1.SubjectAccessReviewInterface,
-	compressState bool,
-	minifyState bool,
+	options Options,
 ) http.Handler {
-	return &handler{
-		coreClient:           coreClient,
-		authenticationClient: authenticationClient,
-		authorizationClient:  authorizationClient,
-		compressState:        compressState,
-		minifyState:          minifyState,
-	}
-}
-
-// lockInfo stores lock metadata.
-//
-// Copied and trimmed from https://github.com/hashicorp/terraform/blob/master/states/statemgr/locker.go#L110-L138
-type lockInfo struct {
-	// Unique ID for the lock.
-	ID string
-	// Terraform operation, provided by the caller.
-	Operation string
-	// Extra information to store with the lock, provided by the caller.
-	Info string
-	// user@hostname when available
-	Who string
+	return metrics.InstrumentHandler(&handler{
+		stores:              stores,
+		authenticator:       authenticator,
+		authorizationClient: authorizationClient,
+		options:             options,
+	})
 }
 
 func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	_, token, ok := req.BasicAuth()
+	resp, ok, err := authenticate(h.authenticator, req)
+	if err != nil {
+		log.Printf("failed to authenticate request: %v", err)
+		handleAPIError(err, w)
+		return
+	}
 	if !ok {
+		// Terraform only sends credentials via Basic authentication once challenged.
+		if _, _, basicAuth := req.BasicAuth(); basicAuth {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
 		w.Header().Set("WWW-Authenticate", `Basic realm="Terraform "`)
 		w.WriteHeader(401)
 		return
 	}
+	userInfo := toUserInfo(resp.User)
 
-	tokenReviewResponse, err := h.authenticationClient.Create(&authenticationapi.TokenReview{
-		Spec: authenticationapi.TokenReviewSpec{
-			Token: token,
-		},
-	})
-	if err != nil {
-		log.Printf("failed to validate authentication token: %v", err)
-		h.handleAPIError(err, w)
-		return
+	log.Print(req.URL.Path)
+
+	if h.options.MaxRequestSize > 0 {
+		req.Body = &limitedBody{ReadCloser: req.Body, limit: h.options.MaxRequestSize, remaining: h.options.MaxRequestSize}
 	}
-	if !tokenReviewResponse.Status.Authenticated {
-		w.WriteHeader(http.StatusForbidden)
+
+	r, ok := h.parseRoute(req.URL)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	userInfo := tokenReviewResponse.Status.User
-
-	log.Print(req.URL.Path)
-
-	splitPath := strings.Split(req.URL.Path[1:], "/")
-	if len(splitPath) != 2 {
+	allowed := allowedMethods(r)
+	if allowed == nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	if !checkMethod(allowed, req, w) {
+		return
+	}
+	if r.key.Name == "" {
+		h.handleList(r, userInfo, req, w)
+		return
+	}
+	if err := r.validate(); err != nil {
+		h.handleStoreError(err, w)
+		return
+	}
+	if r.subresource == subresourceOutputs {
+		h.handleOutputs(r, userInfo, req, w)
+		return
+	}
+	store, key := r.store, r.key
 
-	namespace := splitPath[0]
-	configMapName := splitPath[1]
-
-	sarResponse, err := h.authorizationClient.Create(&authorizationapi.SubjectAccessReview{
-		Spec: authorizationapi.SubjectAccessReviewSpec{
-			User: userInfo.Username,
-			UID:  userInfo.UID,
-			ResourceAttributes: &authorizationapi.ResourceAttributes{
-				Resource:  "configmaps",
-				Namespace: namespace,
-				Name:      configMapName,
-				Verb:      "get",
-			},
-		},
-	})
+	sarSpec := subjectAccessReviewSpec(userInfo)
+	sarSpec.ResourceAttributes = h.resourceAttributes(store.Resource(), "", "get", key)
+	sarResponse, err := reviewAccess(h.authorizationClient, &authorizationapi.SubjectAccessReview{Spec: sarSpec})
 	if err != nil {
 		log.Printf("failed to check authorization: %v", err)
-		h.handleAPIError(err, w)
+		handleAPIError(err, w)
 		return
 	}
 
@@ -144,255 +145,264 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if r.subresource == subresourceWorkspaces {
+		h.handleWorkspaces(r, req, w)
+		return
+	}
+
 	apiVerb := "get"
 
 	exists := true
-	configMapClient := h.coreClient.ConfigMaps(namespace)
-	configMap, err := configMapClient.Get(configMapName, metav1.GetOptions{})
+	state, err := store.Get(key)
 	if err != nil {
-		if !errors.IsNotFound(err) {
-			log.Printf("failed to get configmap: %v", err)
-			h.handleAPIError(err, w)
+		if !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("failed to get state %s: %v", key, err)
+			h.handleStoreError(err, w)
 			return
 		}
 		exists = false
 	}
 
-	switch req.Method {
-	case http.MethodGet:
-		h.handleGET(configMap, w)
-	case http.MethodPost:
+	if r.subresource == subresourceVersions {
+		h.handleVersions(r, exists, userInfo, req, w)
+		return
+	}
+
+	method := req.Method
+	if r.subresource == subresourceLock {
+		method = lockMethod(method)
+	}
+
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		h.handleGET(state, req, w)
+	case http.MethodPost, http.MethodPut:
 		if exists {
 			apiVerb = "update"
 		} else {
 			apiVerb = "create"
 		}
-		h.handlePOST(configMap, configMapClient, apiVerb, namespace, configMapName, userInfo, req, w)
+		h.handlePOST(store, apiVerb, key, userInfo, req, w)
 	case http.MethodDelete:
-		h.handleDELETE(configMap, configMapClient, namespace, configMapName, userInfo, req, w)
+		h.handleDELETE(store, key, userInfo, req, w)
 	case MethodLock:
 		if exists {
 			apiVerb = "update"
 		} else {
 			apiVerb = "create"
 		}
-		h.handleLOCK(configMap, configMapClient, apiVerb, namespace, configMapName, userInfo, req, w)
+		h.handleLOCK(store, apiVerb, key, userInfo, req, w)
 	case MethodUnlock:
 		if !exists {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		h.handleUNLOCK(configMap, configMapClient, namespace, configMapName, userInfo, req, w)
+		h.handleUNLOCK(store, key, userInfo, req, w)
 	default:
 		w.WriteHeader(http.StatusNotFound)
 	}
 
 }
 
-func (h *handler) handleGET(configMap *v1.ConfigMap, w http.ResponseWriter) {
-	if state, ok := configMap.BinaryData["tfstate"]; ok {
-		var r io.Reader = bytes.NewReader(state)
-		if h.compressState {
-			var err error
-			r, err = gzip.NewReader(r)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintf(w, "failed to read compressed Terraform state: %s", err)
-				return
-			}
-		}
-		if _, err := io.Copy(w, r); err != nil {
+// handleGET returns the state. A state that exists but has not been written yet, e.g. because it has only been locked,
+// is returned as 204 No Content, which Terraform treats as no state in the same way as 404 Not Found.
+func (h *handler) handleGET(state *storage.State, req *http.Request, w http.ResponseWriter) {
+	if state.Open == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if state.ETag != "" && notModified(req.Header.Get("If-None-Match"), state.ETag) {
+		w.Header().Set("ETag", quoteETag(state.ETag))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// The state is not read for HEAD requests, so it is only verified on GET.
+	var r io.ReadCloser
+	if req.Method != http.MethodHead {
+		var err error
+		if r, err = state.Open(); err != nil {
+			log.Printf("failed to read Terraform state: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "failed to return Terraform state: %s", err)
+			fmt.Fprintf(w, "failed to read Terraform state: %s", err)
 			return
 		}
-		if rc, ok := r.(io.Closer); ok {
-			if err := rc.Close(); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintf(w, "failed to return Terraform state: %s", err)
-				return
-			}
-		}
 	}
-}
-
-func (h *handler) handlePOST(configMap *v1.ConfigMap, configMapClient corev1.ConfigMapInterface,
-	apiVerb, namespace, configMapName string, userInfo authenticationapi.UserInfo,
-	req *http.Request, w http.ResponseWriter) {
-	err := h.checkAccess(apiVerb, namespace, configMapName, userInfo)
-	if err != nil {
-		log.Printf("failed to check access to update configmap: %v", err)
-		h.handleAPIError(err, w)
-		return
+	w.Header().Set("Content-Type", "application/json")
+	if state.ETag != "" {
+		w.Header().Set("ETag", quoteETag(state.ETag))
 	}
-
-	// If the configmap is locked, then check the request comes from the locker.
-	if !h.checkRequestIsFromLocker(configMap, w, req) {
+	if state.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(state.ContentLength, 10))
+	}
+	if r == nil {
 		return
 	}
-
-	reqTFState, err := h.getTFStateForWriting(req.Body)
-	if err != nil {
+	defer r.Close()
+	if n, err := io.Copy(w, r); err != nil {
+		log.Printf("failed to return Terraform state: %v", err)
+		// Once part of the state has been sent the status can no longer be changed, so the connection is aborted
+		// for the client to see a truncated response rather than a successful one.
+		if n > 0 {
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Del("ETag")
+		w.Header().Del("Content-Length")
 		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "failed to read request body: %s", err)
-		return
+		fmt.Fprintf(w, "failed to return Terraform state: %s", err)
 	}
+}
 
-	if configMap.BinaryData == nil {
-		configMap.BinaryData = make(map[string][]byte, 1)
+func (h *handler) handlePOST(store storage.StateStore, apiVerb string, key storage.Key,
+	userInfo authenticationapi.UserInfo, req *http.Request, w http.ResponseWriter) {
+	err := h.checkAccess(store.Resource(), apiVerb, key, userInfo)
+	if err != nil {
+		log.Printf("failed to check access to update %s: %v", store.Resource(), err)
+		handleAPIError(err, w)
+		return
 	}
-	configMap.BinaryData["tfstate"] = reqTFState
 
-	switch apiVerb {
-	case "update":
-		configMap, err = configMapClient.Update(configMap)
-	case "create":
-		configMap.Name = configMapName
-		configMap, err = configMapClient.Create(configMap)
+	force, _ := strconv.ParseBool(req.URL.Query().Get("force"))
+	putOptions := storage.PutOptions{LockID: req.URL.Query().Get("ID"), Force: force}
+	// Terraform sends the MD5 digest of the state so that truncated state is never stored.
+	if contentMD5 := req.Header.Get("Content-MD5"); contentMD5 != "" {
+		digest, err := base64.StdEncoding.DecodeString(contentMD5)
+		if err != nil || len(digest) != md5.Size {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid Content-MD5 header %q", contentMD5)
+			return
+		}
+		putOptions.ContentMD5 = digest
 	}
-
-	if err != nil {
-		log.Printf("failed to create/update configmap: %v", err)
-		h.handleAPIError(err, w)
+	// If-Match allows read-modify-write of state without holding a lock.
+	putOptions.IfMatch = parseETags(req.Header.Get("If-Match"), false)
+	if err := store.Put(key, req.Body, putOptions); err != nil {
+		log.Printf("failed to write state %s: %v", key, err)
+		h.handleStoreError(err, w)
 	}
 }
 
-func (h *handler) handleDELETE(configMap *v1.ConfigMap, configMapClient corev1.ConfigMapInterface,
-	namespace, configMapName string, userInfo authenticationapi.UserInfo,
-	req *http.Request, w http.ResponseWriter) {
-	err := h.checkAccess("delete", namespace, configMapName, userInfo)
+func (h *handler) handleDELETE(store storage.StateStore, key storage.Key,
+	userInfo authenticationapi.UserInfo, req *http.Request, w http.ResponseWriter) {
+	err := h.checkAccess(store.Resource(), "delete", key, userInfo)
 	if err != nil {
-		log.Printf("failed to check access to delete configmap: %v", err)
-		h.handleAPIError(err, w)
+		log.Printf("failed to check access to delete %s: %v", store.Resource(), err)
+		handleAPIError(err, w)
 		return
 	}
 
-	// If the configmap is locked, then check the request comes from the locker.
-	if !h.checkRequestIsFromLocker(configMap, w, req) {
+	if err := store.Delete(key, req.URL.Query().Get("ID")); err != nil {
+		log.Printf("failed to delete state %s: %v", key, err)
+		h.handleStoreError(err, w)
 		return
 	}
-
-	if err = configMapClient.Delete(configMapName, &metav1.DeleteOptions{}); err != nil && errors.IsNotFound(err) {
-		log.Printf("failed to delete configmap: %v", err)
-		h.handleAPIError(err, w)
-	}
 }
 
-func (h *handler) handleLOCK(configMap *v1.ConfigMap, configMapClient corev1.ConfigMapInterface,
-	apiVerb, namespace, configMapName string, userInfo authenticationapi.UserInfo,
-	req *http.Request, w http.ResponseWriter) {
-	err := h.checkAccess(apiVerb, namespace, configMapName, userInfo)
+func (h *handler) handleLOCK(store storage.StateStore, apiVerb string, key storage.Key,
+	userInfo authenticationapi.UserInfo, req *http.Request, w http.ResponseWriter) {
+	err := h.checkSubresourceAccess(store.Resource(), subresourceLock, apiVerb, key, userInfo)
 	if err != nil {
-		log.Printf("failed to check access to update configmap: %v", err)
-		h.handleAPIError(err, w)
+		log.Printf("failed to check access to lock %s: %v", store.Resource(), err)
+		handleAPIError(err, w)
 		return
 	}
 
-	requestLockInfo := &lockInfo{}
-	if err := json.NewDecoder(req.Body).Decode(requestLockInfo); err != nil {
+	requestLockInfo := storage.LockInfo{}
+	if err := json.NewDecoder(req.Body).Decode(&requestLockInfo); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "failed to read request body: %s", err)
 		return
 	}
 
-	if currentLockID, locked := configMap.Annotations[annotationKeyLockID]; locked &&
-		currentLockID != requestLockInfo.ID {
-		existingLockInfo := lockInfo{
-			ID:        configMap.Annotations[annotationKeyLockID],
-			Operation: configMap.Annotations[annotationKeyLockOperation],
-			Info:      configMap.Annotations[annotationKeyLockInfo],
-			Who:       configMap.Annotations[annotationKeyLockWho],
-		}
-		w.WriteHeader(http.StatusLocked)
-		_ = json.NewEncoder(w).Encode(existingLockInfo)
+	if err := store.Lock(key, requestLockInfo); err != nil {
+		log.Printf("failed to lock state %s: %v", key, err)
+		h.handleStoreError(err, w)
 		return
 	}
-
-	if configMap.Annotations == nil {
-		configMap.Annotations = make(map[string]string, 4)
-	}
-
-	configMap.Annotations[annotationKeyLockID] = requestLockInfo.ID
-	configMap.Annotations[annotationKeyLockOperation] = requestLockInfo.Operation
-	configMap.Annotations[annotationKeyLockInfo] = requestLockInfo.Info
-	configMap.Annotations[annotationKeyLockWho] = requestLockInfo.Who
-
-	switch apiVerb {
-	case "update":
-		configMap, err = configMapClient.Update(configMap)
-	case "create":
-		configMap.Name = configMapName
-		configMap, err = configMapClient.Create(configMap)
-	}
-
-	if err != nil {
-		log.Printf("failed to lock configmap: %v", err)
-		h.handleAPIError(err, w)
-	}
 }
 
-func (h *handler) handleUNLOCK(configMap *v1.ConfigMap, configMapClient corev1.ConfigMapInterface,
-	namespace, configMapName string, userInfo authenticationapi.UserInfo,
-	req *http.Request, w http.ResponseWriter) {
-	err := h.checkAccess("update", namespace, configMapName, userInfo)
+func (h *handler) handleUNLOCK(store storage.StateStore, key storage.Key,
+	userInfo authenticationapi.UserInfo, req *http.Request, w http.ResponseWriter) {
+	err := h.checkSubresourceAccess(store.Resource(), subresourceLock, "update", key, userInfo)
 	if err != nil {
-		log.Printf("failed to check access to update configmap: %v", err)
-		h.handleAPIError(err, w)
+		log.Printf("failed to check access to unlock %s: %v", store.Resource(), err)
+		handleAPIError(err, w)
 		return
 	}
 
+	// An unlock request without lock info forcibly unlocks the state.
+	var requestLockInfo *storage.LockInfo
 	if req.ContentLength > 0 {
-		requestLockInfo := &lockInfo{}
+		requestLockInfo = &storage.LockInfo{}
 		if err := json.NewDecoder(req.Body).Decode(requestLockInfo); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "failed to read request body: %s", err)
 			return
 		}
+	}
 
-		if currentLockID, locked := configMap.Annotations[annotationKeyLockID]; locked &&
-			currentLockID != requestLockInfo.ID {
-			existingLockInfo := lockInfo{
-				ID:        configMap.Annotations[annotationKeyLockID],
-				Operation: configMap.Annotations[annotationKeyLockOperation],
-				Info:      configMap.Annotations[annotationKeyLockInfo],
-				Who:       configMap.Annotations[annotationKeyLockWho],
-			}
-			w.WriteHeader(http.StatusLocked)
-			_ = json.NewEncoder(w).Encode(existingLockInfo)
-			return
-		}
+	if err := store.Unlock(key, requestLockInfo); err != nil {
+		log.Printf("failed to unlock state %s: %v", key, err)
+		h.handleStoreError(err, w)
+		return
 	}
+}
 
-	delete(configMap.Annotations, annotationKeyLockID)
-	delete(configMap.Annotations, annotationKeyLockOperation)
-	delete(configMap.Annotations, annotationKeyLockInfo)
-	delete(configMap.Annotations, annotationKeyLockWho)
+// stateHeader identifies a Terraform state in a conflictResponse.
+type stateHeader struct {
+	Lineage string `json:"lineage"`
+	Serial  uint64 `json:"serial"`
+}
 
-	configMap, err = configMapClient.Update(configMap)
-	if err != nil {
-		log.Printf("failed to unlock configmap: %v", err)
-		h.handleAPIError(err, w)
-	}
+// conflictResponse is returned when a state write is rejected because its lineage or serial conflicts with the
+// stored state.
+type conflictResponse struct {
+	Error     string      `json:"error"`
+	Stored    stateHeader `json:"stored"`
+	Requested stateHeader `json:"requested"`
 }
 
-func (h *handler) checkRequestIsFromLocker(configMap *v1.ConfigMap, w http.ResponseWriter, req *http.Request) bool {
-	if configMap.Annotations[annotationKeyLockID] != req.URL.Query().Get("ID") {
-		existingLockInfo := lockInfo{
-			ID:        configMap.Annotations[annotationKeyLockID],
-			Operation: configMap.Annotations[annotationKeyLockOperation],
-			Info:      configMap.Annotations[annotationKeyLockInfo],
-			Who:       configMap.Annotations[annotationKeyLockWho],
-		}
+// handleStoreError writes the response for errors returned by a storage.StateStore.
+func (h *handler) handleStoreError(err error, w http.ResponseWriter) {
+	var lockedErr *storage.LockedError
+	var conflictErr *storage.ConflictError
+	var tooLargeErr *requestTooLargeError
+	switch {
+	case errors.As(err, &tooLargeErr):
+		w.Header().Set("Connection", "close")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprint(w, tooLargeErr)
+	case errors.As(err, &lockedErr):
+		metrics.LockContentionTotal.Inc()
 		w.WriteHeader(http.StatusLocked)
-		_ = json.NewEncoder(w).Encode(existingLockInfo)
-		return false
+		_ = json.NewEncoder(w).Encode(lockedErr.Lock)
+	case errors.As(err, &conflictErr):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(conflictResponse{
+			Error:     conflictErr.Reason,
+			Stored:    stateHeader{Lineage: conflictErr.Stored.Lineage, Serial: conflictErr.Stored.Serial},
+			Requested: stateHeader{Lineage: conflictErr.Requested.Lineage, Serial: conflictErr.Requested.Serial},
+		})
+	case errors.Is(err, storage.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, storage.ErrPreconditionFailed):
+		w.WriteHeader(http.StatusPreconditionFailed)
+	case errors.Is(err, storage.ErrChecksumMismatch), errors.Is(err, storage.ErrInvalidKey):
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+	default:
+		handleAPIError(err, w)
 	}
-	return true
 }
 
-func (h *handler) handleAPIError(err error, w http.ResponseWriter) {
-	if statusError, ok := err.(*errors.StatusError); ok {
+func handleAPIError(err error, w http.ResponseWriter) {
+	if statusError, ok := err.(*apierrors.StatusError); ok {
 		w.WriteHeader(int(statusError.Status().Code))
 		w.Write([]byte(statusError.Error()))
 	} else {
@@ -400,52 +410,122 @@ func (h *handler) handleAPIError(err error, w http.ResponseWriter) {
 	}
 }
 
-func (h *handler) checkAccess(apiVerb, namespace, configMapName string, userInfo authenticationapi.UserInfo) error {
-	sarResponse, err := h.authorizationClient.Create(&authorizationapi.SubjectAccessReview{
-		Spec: authorizationapi.SubjectAccessReviewSpec{
-			User: userInfo.Username,
-			UID:  userInfo.UID,
-			ResourceAttributes: &authorizationapi.ResourceAttributes{
-				Resource:  "configmaps",
-				Namespace: namespace,
-				Name:      configMapName,
-				Verb:      apiVerb,
-			},
-		},
-	})
+// authenticate authenticates the request with authn, recording its latency and errors in metrics.
+func authenticate(authn authenticator.Request, req *http.Request) (*authenticator.Response, bool, error) {
+	defer metrics.ObserveDuration(metrics.AuthenticationDuration, time.Now())
+	resp, ok, err := authn.AuthenticateRequest(req)
+	if err != nil {
+		metrics.AuthenticationErrorsTotal.Inc()
+	}
+	return resp, ok, err
+}
+
+// toUserInfo converts an authenticated user for use in SubjectAccessReviews.
+func toUserInfo(u user.Info) authenticationapi.UserInfo {
+	userInfo := authenticationapi.UserInfo{
+		Username: u.GetName(),
+		UID:      u.GetUID(),
+		Groups:   u.GetGroups(),
+	}
+	if extra := u.GetExtra(); len(extra) > 0 {
+		userInfo.Extra = make(map[string]authenticationapi.ExtraValue, len(extra))
+		for k, v := range extra {
+			userInfo.Extra[k] = v
+		}
+	}
+	return userInfo
+}
+
+// subjectAccessReviewSpec returns the spec of a SubjectAccessReview of the user.
+func subjectAccessReviewSpec(userInfo authenticationapi.UserInfo) authorizationapi.SubjectAccessReviewSpec {
+	spec := authorizationapi.SubjectAccessReviewSpec{
+		User:   userInfo.Username,
+		UID:    userInfo.UID,
+		Groups: userInfo.Groups,
+	}
+	if len(userInfo.Extra) > 0 {
+		spec.Extra = make(map[string]authorizationapi.ExtraValue, len(userInfo.Extra))
+		for k, v := range userInfo.Extra {
+			spec.Extra[k] = authorizationapi.ExtraValue(v)
+		}
+	}
+	return spec
+}
+
+// reviewAccess creates a SubjectAccessReview, recording its latency and errors in metrics.
+func reviewAccess(client authorizationv1.SubjectAccessReviewInterface,
+	sar *authorizationapi.SubjectAccessReview) (*authorizationapi.SubjectAccessReview, error) {
+	defer metrics.ObserveDuration(metrics.AuthorizationDuration, time.Now())
+	sarResponse, err := client.Create(sar)
+	if err != nil {
+		metrics.AuthorizationErrorsTotal.Inc()
+	}
+	return sarResponse, err
+}
+
+func (h *handler) checkAccess(resource, apiVerb string, key storage.Key, userInfo authenticationapi.UserInfo) error {
+	return h.checkSubresourceAccess(resource, "", apiVerb, key, userInfo)
+}
+
+// checkSubresourceAccess checks access to a subresource of the object storing the state, or of the virtual resource if
+// enabled. Subresources such as outputs do not exist in the Kubernetes API, but can still be granted in RBAC rules,
+// e.g. configmaps/outputs.
+func (h *handler) checkSubresourceAccess(resource, subresource, apiVerb string, key storage.Key,
+	userInfo authenticationapi.UserInfo) error {
+	sarSpec := subjectAccessReviewSpec(userInfo)
+	attributes := h.resourceAttributes(resource, subresource, apiVerb, key)
+	sarSpec.ResourceAttributes = attributes
+	sarResponse, err := reviewAccess(h.authorizationClient, &authorizationapi.SubjectAccessReview{Spec: sarSpec})
 	if err != nil {
 		log.Printf("failed to check authorization: %v", err)
 		return err
 	}
 
 	if !sarResponse.Status.Allowed {
-		return errors.NewForbidden(v1.SchemeGroupVersion.WithResource("configmaps").GroupResource(), configMapName, nil)
+		groupResource := schema.GroupResource{Group: attributes.Group, Resource: attributes.Resource}
+		return apierrors.NewForbidden(groupResource, key.Name, nil)
 	}
 
 	return nil
 }
 
-func (h *handler) getTFStateForWriting(r io.Reader) ([]byte, error) {
-	var buf bytes.Buffer
-	w := io.Writer(&buf)
-	if h.compressState {
-		gzw, err := gzip.NewWriterLevel(w, gzip.BestCompression)
-		if err != nil {
-			return nil, err
-		}
-		w = gzw
+// requestTooLargeError is returned when reading a request body larger than the maximum request size.
+type requestTooLargeError struct {
+	limit int64
+}
+
+func (e *requestTooLargeError) Error() string {
+	return fmt.Sprintf("request body exceeds the maximum size of %d bytes", e.limit)
+}
+
+// limitedBody limits the size of a request body as http.MaxBytesReader does, but returns a *requestTooLargeError so
+// that oversized requests can be identified without http.MaxBytesError, which requires Go 1.19.
+type limitedBody struct {
+	io.ReadCloser
+	limit     int64
+	remaining int64
+	err       error
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
 	}
-	if h.minifyState {
-		if err := minifyjson.Minify(nil, w, r, nil); err != nil {
-			return nil, err
-		}
-	} else if _, err := io.Copy(w, r); err != nil {
-		return nil, err
+	if len(p) == 0 {
+		return 0, nil
 	}
-	if wc, ok := w.(io.Closer); ok {
-		if err := wc.Close(); err != nil {
-			return nil, err
-		}
+	// Read one byte more than remaining to detect bodies exceeding the limit.
+	if int64(len(p))-1 > b.remaining {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.remaining {
+		b.remaining -= int64(n)
+		b.err = err
+		return n, err
 	}
-	return buf.Bytes(), nil
+	n = int(b.remaining)
+	b.remaining = 0
+	b.err = &requestTooLargeError{limit: b.limit}
+	return n, b.err
 }
@@ -0,0 +1,516 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	authenticationapi "k8s.io/api/authentication/v1"
+	authorizationapi "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/encryption"
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/kubernetes"
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/storage"
+)
+
+const testState = `{"version": 4, "terraform_version": "0.12.24", "serial": 1, "lineage": "test", "outputs": {}}`
+
+// newTestHandler returns a handler storing state in configmaps of a fake clientset that authenticates every token and
+// authorizes every request.
+func newTestHandler(t *testing.T) (http.Handler, *fake.Clientset) {
+	t.Helper()
+	return newTestHandlerWithOptions(t, storage.Options{}, Options{})
+}
+
+// newTestHandlerWithOptions returns a handler as newTestHandler, with the specified options.
+func newTestHandlerWithOptions(t *testing.T, storageOptions storage.Options,
+	options Options) (http.Handler, *fake.Clientset) {
+	t.Helper()
+	client := fake.NewSimpleClientset()
+	withOptimisticConcurrency(client)
+	client.PrependReactor("create", "tokenreviews",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			review := action.(k8stesting.CreateAction).GetObject().(*authenticationapi.TokenReview)
+			review.Status = authenticationapi.TokenReviewStatus{
+				Authenticated: review.Spec.Token != "invalid",
+				User:          authenticationapi.UserInfo{Username: review.Spec.Token},
+			}
+			return true, review, nil
+		})
+	client.PrependReactor("create", "subjectaccessreviews",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			review := action.(k8stesting.CreateAction).GetObject().(*authorizationapi.SubjectAccessReview)
+			review.Status.Allowed = true
+			return true, review, nil
+		})
+
+	store, err := storage.NewKubernetesStore(client, storage.ResourceConfigMaps, storageOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authn := kubernetes.NewBasicAuthAuthenticator(kubernetes.NewTokenReviewAuthenticator(client.AuthenticationV1().TokenReviews()))
+	handler := NewHandler([]storage.StateStore{store}, authn, client.AuthorizationV1().SubjectAccessReviews(), options)
+	return handler, client
+}
+
+// withOptimisticConcurrency makes the fake clientset assign resourceVersions and creation timestamps and reject updates
+// with a stale resourceVersion, as the API server does, so that concurrent requests behave as they would against a real
+// cluster.
+func withOptimisticConcurrency(client *fake.Clientset) {
+	var mu sync.Mutex
+	resourceVersion := 0
+	kinds := map[string]string{"configmaps": "ConfigMap", "secrets": "Secret", "leases": "Lease"}
+	for resource, kind := range kinds {
+		client.PrependReactor("create", resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+			create := action.(k8stesting.CreateAction)
+			obj := create.GetObject().DeepCopyObject()
+			objMeta, err := meta.Accessor(obj)
+			if err != nil {
+				return true, nil, err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			resourceVersion++
+			objMeta.SetResourceVersion(strconv.Itoa(resourceVersion))
+			objMeta.SetCreationTimestamp(metav1.Now())
+			if err := client.Tracker().Create(create.GetResource(), obj, create.GetNamespace()); err != nil {
+				return true, nil, err
+			}
+			return true, obj, nil
+		})
+		client.PrependReactor("update", resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+			update := action.(k8stesting.UpdateAction)
+			obj := update.GetObject().DeepCopyObject()
+			objMeta, err := meta.Accessor(obj)
+			if err != nil {
+				return true, nil, err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			existing, err := client.Tracker().Get(update.GetResource(), update.GetNamespace(), objMeta.GetName())
+			if err != nil {
+				return true, nil, err
+			}
+			existingMeta, err := meta.Accessor(existing)
+			if err != nil {
+				return true, nil, err
+			}
+			if objMeta.GetResourceVersion() != "" && objMeta.GetResourceVersion() != existingMeta.GetResourceVersion() {
+				return true, nil, apierrors.NewConflict(update.GetResource().GroupResource(), objMeta.GetName(),
+					errors.New("the object has been modified"))
+			}
+			resourceVersion++
+			objMeta.SetResourceVersion(strconv.Itoa(resourceVersion))
+			if err := client.Tracker().Update(update.GetResource(), obj, update.GetNamespace()); err != nil {
+				return true, nil, err
+			}
+			return true, obj, nil
+		})
+		client.PrependReactor("delete-collection", resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+			deleteCollection := action.(k8stesting.DeleteCollectionAction)
+			gvr := deleteCollection.GetResource()
+			mu.Lock()
+			defer mu.Unlock()
+			list, err := client.Tracker().List(gvr, gvr.GroupVersion().WithKind(kind), deleteCollection.GetNamespace())
+			if err != nil {
+				return true, nil, err
+			}
+			objs, err := meta.ExtractList(list)
+			if err != nil {
+				return true, nil, err
+			}
+			for _, obj := range objs {
+				objMeta, err := meta.Accessor(obj)
+				if err != nil {
+					return true, nil, err
+				}
+				if !deleteCollection.GetListRestrictions().Labels.Matches(labels.Set(objMeta.GetLabels())) {
+					continue
+				}
+				if err := client.Tracker().Delete(gvr, deleteCollection.GetNamespace(), objMeta.GetName()); err != nil {
+					return true, nil, err
+				}
+			}
+			return true, nil, nil
+		})
+	}
+}
+
+// denyAccess makes the fake clientset deny SubjectAccessReviews of verb on the subresource.
+func denyAccess(client *fake.Clientset, verb, subresource string) {
+	client.PrependReactor("create", "subjectaccessreviews",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			review := action.(k8stesting.CreateAction).GetObject().(*authorizationapi.SubjectAccessReview)
+			attributes := review.Spec.ResourceAttributes
+			if attributes == nil || attributes.Verb != verb || attributes.Subresource != subresource {
+				return false, nil, nil
+			}
+			review.Status.Denied = true
+			return true, review, nil
+		})
+}
+
+// recordAccessReviews records the resource attributes of all SubjectAccessReviews made with the fake clientset.
+func recordAccessReviews(client *fake.Clientset) *[]authorizationapi.ResourceAttributes {
+	var mu sync.Mutex
+	var reviewed []authorizationapi.ResourceAttributes
+	client.PrependReactor("create", "subjectaccessreviews",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			review := action.(k8stesting.CreateAction).GetObject().(*authorizationapi.SubjectAccessReview)
+			if review.Spec.ResourceAttributes != nil {
+				mu.Lock()
+				reviewed = append(reviewed, *review.Spec.ResourceAttributes)
+				mu.Unlock()
+			}
+			return false, nil, nil
+		})
+	return &reviewed
+}
+
+func TestTerraformFlow(t *testing.T) {
+	for _, lockMode := range storage.LockModes {
+		t.Run(lockMode, func(t *testing.T) {
+			handler, _ := newTestHandlerWithOptions(t, storage.Options{LockMode: lockMode}, Options{})
+
+			// terraform init/apply of a new state.
+			expect(t, handler, MethodLock, "/default/state", `{"ID": "1", "Operation": "OperationTypeApply"}`, nil,
+				http.StatusOK)
+			// A locked state that has never been written exists but is empty, whichever lock mode holds the lock.
+			expect(t, handler, http.MethodGet, "/default/state", "", nil, http.StatusNoContent)
+			expect(t, handler, http.MethodPost, "/default/state?ID=1", testState, nil, http.StatusOK)
+			rec := expect(t, handler, http.MethodGet, "/default/state", "", nil, http.StatusOK)
+			if got := rec.Body.String(); got != testState {
+				t.Errorf("expected state %q, got %q", testState, got)
+			}
+			expect(t, handler, MethodUnlock, "/default/state", `{"ID": "1"}`, nil, http.StatusOK)
+
+			// A process that died holding the lock is recovered with terraform force-unlock.
+			expect(t, handler, MethodLock, "/default/state", `{"ID": "2"}`, nil, http.StatusOK)
+			expect(t, handler, MethodLock, "/default/state", `{"ID": "3"}`, nil, http.StatusLocked)
+			expect(t, handler, MethodUnlock, "/default/state", "", nil, http.StatusOK)
+			expect(t, handler, MethodLock, "/default/state", `{"ID": "3"}`, nil, http.StatusOK)
+
+			// terraform workspace delete.
+			expect(t, handler, http.MethodDelete, "/default/state", "", nil, http.StatusLocked)
+			expect(t, handler, http.MethodDelete, "/default/state?ID=3", "", nil, http.StatusOK)
+			expect(t, handler, http.MethodGet, "/default/state", "", nil, http.StatusNotFound)
+		})
+	}
+}
+
+func TestStateChecks(t *testing.T) {
+	foreignState := strings.Replace(testState, `"lineage": "test"`, `"lineage": "foreign"`, 1)
+	olderState := strings.Replace(testState, `"serial": 1`, `"serial": 0`, 1)
+
+	handler, _ := newTestHandler(t)
+	expect(t, handler, http.MethodPost, "/default/state", testState, nil, http.StatusOK)
+	expect(t, handler, http.MethodPost, "/default/state", foreignState, nil, http.StatusConflict)
+	expect(t, handler, http.MethodPost, "/default/state", olderState, nil, http.StatusConflict)
+	expect(t, handler, http.MethodPost, "/default/state", "[]", nil, http.StatusConflict)
+
+	// A forced write of state without a readable header keeps the recorded lineage and serial.
+	expect(t, handler, http.MethodPost, "/default/state?force=true", "[]", nil, http.StatusOK)
+	expect(t, handler, http.MethodPost, "/default/state", foreignState, nil, http.StatusConflict)
+	expect(t, handler, http.MethodPost, "/default/state", testState, nil, http.StatusOK)
+}
+
+func TestAuthenticationDenied(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	rec := request(t, handler, "invalid", http.MethodGet, "/default/state", "", nil)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, rec.Code)
+	}
+}
+
+func TestAuthorizationDenied(t *testing.T) {
+	updatedState := strings.Replace(testState, `"serial": 1`, `"serial": 2`, 1)
+	for _, c := range []struct {
+		name        string
+		existing    bool
+		locked      bool
+		method      string
+		path        string
+		body        string
+		verb        string
+		subresource string
+	}{
+		{name: "get", existing: true, method: http.MethodGet, path: "/default/state", verb: "get"},
+		{name: "create", method: http.MethodPost, path: "/default/state", body: testState, verb: "create"},
+		{name: "update", existing: true, method: http.MethodPost, path: "/default/state", body: updatedState,
+			verb: "update"},
+		{name: "delete", existing: true, method: http.MethodDelete, path: "/default/state", verb: "delete"},
+		{name: "lock new", method: MethodLock, path: "/default/state", body: `{"ID": "1"}`, verb: "create"},
+		{name: "lock existing", existing: true, method: MethodLock, path: "/default/state", body: `{"ID": "1"}`,
+			verb: "update"},
+		{name: "unlock", existing: true, locked: true, method: MethodUnlock, path: "/default/state",
+			body: `{"ID": "1"}`, verb: "update"},
+		{name: "list", existing: true, method: http.MethodGet, path: "/default/", verb: "list"},
+		{name: "outputs", existing: true, method: http.MethodGet, path: "/default/state/outputs", verb: "get",
+			subresource: subresourceOutputs},
+		{name: "rollback", existing: true, method: http.MethodPost, path: "/default/state/versions/1/rollback",
+			verb: "update"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			handler, client := newTestHandlerWithOptions(t, storage.Options{HistoryLimit: 1}, Options{})
+			if c.existing {
+				expect(t, handler, http.MethodPost, "/default/state", testState, nil, http.StatusOK)
+				expect(t, handler, http.MethodPost, "/default/state", testState, nil, http.StatusOK)
+			}
+			if c.locked {
+				expect(t, handler, MethodLock, "/default/state", `{"ID": "1"}`, nil, http.StatusOK)
+			}
+
+			denyAccess(client, c.verb, c.subresource)
+			expect(t, handler, c.method, c.path, c.body, nil, http.StatusForbidden)
+		})
+	}
+}
+
+func TestVirtualResourceAuthorization(t *testing.T) {
+	handler, client := newTestHandlerWithOptions(t, storage.Options{}, Options{VirtualResource: true})
+	reviewed := recordAccessReviews(client)
+
+	expect(t, handler, MethodLock, "/default/state", `{"ID": "1"}`, nil, http.StatusOK)
+	expect(t, handler, http.MethodPost, "/default/state?ID=1", testState, nil, http.StatusOK)
+	expect(t, handler, MethodUnlock, "/default/state", `{"ID": "1"}`, nil, http.StatusOK)
+	expect(t, handler, http.MethodGet, "/default/state/outputs", "", nil, http.StatusOK)
+
+	expected := []authorizationapi.ResourceAttributes{
+		{Verb: "get"},
+		{Verb: "create", Subresource: subresourceLock},
+		{Verb: "get"},
+		{Verb: "update"},
+		{Verb: "get"},
+		{Verb: "update", Subresource: subresourceLock},
+		{Verb: "get", Subresource: subresourceOutputs},
+	}
+	if len(*reviewed) != len(expected) {
+		t.Fatalf("expected %d access reviews, got %d: %+v", len(expected), len(*reviewed), *reviewed)
+	}
+	for i, attributes := range *reviewed {
+		expected[i].Group, expected[i].Resource = VirtualResourceGroup, VirtualResource
+		expected[i].Namespace, expected[i].Name = "default", "state"
+		if attributes != expected[i] {
+			t.Errorf("expected access review %+v, got %+v", expected[i], attributes)
+		}
+	}
+}
+
+// testLargeState returns an indented Terraform state of roughly the specified size.
+func testLargeState(t *testing.T, size int) []byte {
+	t.Helper()
+	outputs := map[string]interface{}{}
+	for i := 0; len(outputs)*64 < size; i++ {
+		outputs[fmt.Sprintf("output_%d", i)] = map[string]interface{}{
+			"value": strings.Repeat(strconv.Itoa(i), 8),
+			"type":  "string",
+		}
+	}
+	state, err := json.MarshalIndent(map[string]interface{}{
+		"version":           4,
+		"terraform_version": "0.12.24",
+		"serial":            1,
+		"lineage":           "large-state-lineage",
+		"outputs":           outputs,
+		"resources":         []interface{}{},
+	}, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestStateEncodingRoundTrip(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	if err := ioutil.WriteFile(keyFile, []byte("key1:"+key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyProvider, err := encryption.NewLocalKeyProvider(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := testLargeState(t, 64*1024)
+	var minified bytes.Buffer
+	if err := json.Compact(&minified, state); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name    string
+		options storage.Options
+		// plaintext is true if the state is stored as written, so can be found in the stored objects.
+		plaintext bool
+	}{
+		{name: "none", options: storage.Options{}, plaintext: true},
+		{name: "gzip", options: storage.Options{Compression: storage.CompressionGzip}},
+		{name: "gzip level 1", options: storage.Options{Compression: storage.CompressionGzip, CompressionLevel: 1}},
+		{name: "zstd", options: storage.Options{Compression: storage.CompressionZstd}},
+		{name: "minify", options: storage.Options{Minify: true}, plaintext: true},
+		{name: "gzip minify", options: storage.Options{Compression: storage.CompressionGzip, Minify: true}},
+		{name: "zstd minify chunked", options: storage.Options{
+			Compression: storage.CompressionZstd, Minify: true, ChunkSize: 1024,
+		}},
+		{name: "chunked", options: storage.Options{ChunkSize: 4096}, plaintext: true},
+		{name: "encrypted", options: storage.Options{KeyProvider: keyProvider}},
+		{name: "encrypted gzip chunked", options: storage.Options{
+			Compression: storage.CompressionGzip, KeyProvider: keyProvider, ChunkSize: 1024,
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			handler, client := newTestHandlerWithOptions(t, c.options, Options{})
+			expect(t, handler, http.MethodPost, "/default/state", string(state), nil, http.StatusOK)
+
+			expected := state
+			if c.options.Minify {
+				expected = minified.Bytes()
+			}
+			rec := expect(t, handler, http.MethodGet, "/default/state", "", nil, http.StatusOK)
+			if !bytes.Equal(rec.Body.Bytes(), expected) {
+				t.Errorf("expected state of %d bytes to round trip, got %d bytes", len(expected), rec.Body.Len())
+			}
+			if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(len(expected)) {
+				t.Errorf("expected Content-Length %d, got %q", len(expected), got)
+			}
+
+			configMaps, err := client.CoreV1().ConfigMaps("default").List(metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.options.ChunkSize > 0 && len(configMaps.Items) < 2 {
+				t.Errorf("expected state to be chunked, got %d configmaps", len(configMaps.Items))
+			}
+			found := false
+			for _, configMap := range configMaps.Items {
+				for _, data := range configMap.BinaryData {
+					found = found || bytes.Contains(data, []byte("large-state-lineage"))
+				}
+			}
+			if found != c.plaintext {
+				t.Errorf("expected state stored in plaintext to be %t, got %t", c.plaintext, found)
+			}
+		})
+	}
+}
+
+func TestConcurrentLocks(t *testing.T) {
+	const lockers = 10
+	for _, lockMode := range storage.LockModes {
+		for _, existing := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/existing=%t", lockMode, existing), func(t *testing.T) {
+				handler, _ := newTestHandlerWithOptions(t, storage.Options{LockMode: lockMode}, Options{})
+				if existing {
+					expect(t, handler, http.MethodPost, "/default/state", testState, nil, http.StatusOK)
+				}
+
+				var wg sync.WaitGroup
+				codes := make([]int, lockers)
+				holders := make([]string, lockers)
+				for i := 0; i < lockers; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						rec := request(t, handler, "user", MethodLock, "/default/state",
+							fmt.Sprintf(`{"ID": "%d"}`, i), nil)
+						codes[i] = rec.Code
+						if rec.Code == http.StatusLocked {
+							var lock storage.LockInfo
+							_ = json.Unmarshal(rec.Body.Bytes(), &lock)
+							holders[i] = lock.ID
+						}
+					}(i)
+				}
+				wg.Wait()
+
+				winner := -1
+				for i, code := range codes {
+					switch code {
+					case http.StatusOK:
+						if winner != -1 {
+							t.Fatalf("expected exactly one lock to be acquired, got %d and %d", winner, i)
+						}
+						winner = i
+					case http.StatusLocked:
+					default:
+						t.Fatalf("expected status %d or %d, got %d", http.StatusOK, http.StatusLocked, code)
+					}
+				}
+				if winner == -1 {
+					t.Fatal("expected exactly one lock to be acquired, got none")
+				}
+				for i, holder := range holders {
+					if i != winner && holder != strconv.Itoa(winner) {
+						t.Errorf("expected locked response to report lock %d, got %q", winner, holder)
+					}
+				}
+
+				expect(t, handler, MethodUnlock, "/default/state", fmt.Sprintf(`{"ID": "%d"}`, winner), nil,
+					http.StatusOK)
+			})
+		}
+	}
+}
+
+func TestConcurrentChunkedWrites(t *testing.T) {
+	const writers = 16
+	handler, _ := newTestHandlerWithOptions(t, storage.Options{ChunkSize: 256, SkipStateChecks: true}, Options{})
+
+	states := make(map[string]bool, writers)
+	for round := 0; round < 10; round++ {
+		var wg sync.WaitGroup
+		codes := make([]int, writers)
+		for i := 0; i < writers; i++ {
+			state := string(testLargeState(t, 8*1024+(round*writers+i)*256))
+			states[state] = true
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				codes[i] = request(t, handler, "user", http.MethodPost, "/default/state", state, nil).Code
+			}(i)
+		}
+		wg.Wait()
+
+		for _, code := range codes {
+			if code != http.StatusOK && code != http.StatusConflict {
+				t.Fatalf("expected status %d or %d, got %d", http.StatusOK, http.StatusConflict, code)
+			}
+		}
+		rec := expect(t, handler, http.MethodGet, "/default/state", "", nil, http.StatusOK)
+		if !states[rec.Body.String()] {
+			t.Fatalf("expected one of the written states after round %d, got %d bytes", round, rec.Body.Len())
+		}
+	}
+}
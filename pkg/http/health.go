@@ -0,0 +1,88 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// HealthCheck is a named check of whether the backend is ready to serve requests.
+type HealthCheck struct {
+	Name  string
+	Check func() error
+}
+
+type healthHandler struct {
+	readinessChecks []HealthCheck
+}
+
+// NewHealthHandler returns a handler serving the unauthenticated health endpoints:
+//
+//	/healthz, /livez  succeed while the process is running
+//	/readyz           succeeds if all readiness checks succeed
+//
+// The verbose query parameter lists the result of every check, in the same format as the Kubernetes API server.
+func NewHealthHandler(readinessChecks []HealthCheck) http.Handler {
+	return &healthHandler{readinessChecks: readinessChecks}
+}
+
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var checks []HealthCheck
+	switch req.URL.Path {
+	case "/healthz", "/livez":
+	case "/readyz":
+		checks = h.readinessChecks
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var out bytes.Buffer
+	failed := false
+	for _, check := range checks {
+		if err := check.Check(); err != nil {
+			log.Printf("readiness check %s failed: %v", check.Name, err)
+			fmt.Fprintf(&out, "[-]%s failed: %v\n", check.Name, err)
+			failed = true
+			continue
+		}
+		fmt.Fprintf(&out, "[+]%s ok\n", check.Name)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if failed {
+		w.WriteHeader(http.StatusInternalServerError)
+		out.WriteTo(w)
+		fmt.Fprintf(w, "%s check failed\n", req.URL.Path[1:])
+		return
+	}
+	if _, verbose := req.URL.Query()["verbose"]; verbose {
+		out.WriteTo(w)
+		fmt.Fprintf(w, "%s check passed\n", req.URL.Path[1:])
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
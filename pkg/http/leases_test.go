@@ -0,0 +1,124 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/storage"
+)
+
+const testLockTTL = time.Minute
+
+// newTestLeaseHandler returns a handler locking states with leases that expire after testLockTTL.
+func newTestLeaseHandler(t *testing.T) (http.Handler, *fake.Clientset) {
+	t.Helper()
+	return newTestHandlerWithOptions(t, storage.Options{LockMode: storage.LockModeLease, LockTTL: testLockTTL}, Options{})
+}
+
+// getLease returns the lease locking the state stored in configmap name.
+func getLease(t *testing.T, client *fake.Clientset, name string) *coordinationv1.Lease {
+	t.Helper()
+	lease, err := client.CoordinationV1().Leases("default").Get(name+"-configmaps-lock", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lease
+}
+
+// ageLease moves the acquire and renew times of the lease locking the state stored in configmap name into the past,
+// as if the lock holder had not renewed the lease for age.
+func ageLease(t *testing.T, client *fake.Clientset, name string, age time.Duration) {
+	t.Helper()
+	lease := getLease(t, client, name)
+	past := metav1.NewMicroTime(time.Now().Add(-age))
+	lease.Spec.AcquireTime = &past
+	lease.Spec.RenewTime = &past
+	if _, err := client.CoordinationV1().Leases("default").Update(lease); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLeaseLockTTL(t *testing.T) {
+	handler, client := newTestLeaseHandler(t)
+	expect(t, handler, MethodLock, "/default/state", `{"ID": "1"}`, nil, http.StatusOK)
+
+	lease := getLease(t, client, "state")
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != "1" {
+		t.Errorf("expected lease held by lock 1, got %v", lease.Spec.HolderIdentity)
+	}
+	if lease.Spec.LeaseDurationSeconds == nil || *lease.Spec.LeaseDurationSeconds != int32(testLockTTL/time.Second) {
+		t.Errorf("expected lease duration of %s, got %v", testLockTTL, lease.Spec.LeaseDurationSeconds)
+	}
+
+	// A lock that has not expired cannot be acquired by another lock holder.
+	ageLease(t, client, "state", testLockTTL-10*time.Second)
+	expect(t, handler, MethodLock, "/default/state", `{"ID": "2"}`, nil, http.StatusLocked)
+
+	// An expired lock is no longer enforced, so state can be written without a lock ID.
+	ageLease(t, client, "state", testLockTTL+time.Second)
+	expect(t, handler, http.MethodPost, "/default/state", testState, nil, http.StatusOK)
+}
+
+func TestLeaseLockRenewedOnWrite(t *testing.T) {
+	handler, client := newTestLeaseHandler(t)
+	expect(t, handler, MethodLock, "/default/state", `{"ID": "1"}`, nil, http.StatusOK)
+
+	for _, age := range []time.Duration{testLockTTL - 10*time.Second, testLockTTL + time.Second} {
+		ageLease(t, client, "state", age)
+		before := time.Now().Add(-time.Second)
+		expect(t, handler, http.MethodPost, "/default/state?ID=1", testState, nil, http.StatusOK)
+
+		lease := getLease(t, client, "state")
+		if lease.Spec.RenewTime == nil || lease.Spec.RenewTime.Time.Before(before) {
+			t.Errorf("expected lease aged %s to be renewed by write, got renew time %v", age, lease.Spec.RenewTime)
+		}
+		if lease.Spec.AcquireTime == nil || !lease.Spec.AcquireTime.Time.Before(before) {
+			t.Errorf("expected renewal to keep acquire time, got %v", lease.Spec.AcquireTime)
+		}
+		// The renewed lock, including a lock that had expired but was not reclaimed, is enforced again.
+		expect(t, handler, MethodLock, "/default/state", `{"ID": "2"}`, nil, http.StatusLocked)
+	}
+}
+
+func TestLeaseLockReclaim(t *testing.T) {
+	handler, client := newTestLeaseHandler(t)
+	expect(t, handler, MethodLock, "/default/state", `{"ID": "1"}`, nil, http.StatusOK)
+	ageLease(t, client, "state", testLockTTL+time.Second)
+
+	expect(t, handler, MethodLock, "/default/state", `{"ID": "2"}`, nil, http.StatusOK)
+	lease := getLease(t, client, "state")
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != "2" {
+		t.Errorf("expected lease reclaimed by lock 2, got %v", lease.Spec.HolderIdentity)
+	}
+	if lease.Spec.LeaseTransitions == nil || *lease.Spec.LeaseTransitions != 1 {
+		t.Errorf("expected 1 lease transition, got %v", lease.Spec.LeaseTransitions)
+	}
+
+	// The previous lock holder can no longer write state or unlock.
+	expect(t, handler, http.MethodPost, "/default/state?ID=1", testState, nil, http.StatusLocked)
+	expect(t, handler, MethodUnlock, "/default/state", `{"ID": "1"}`, nil, http.StatusLocked)
+	expect(t, handler, http.MethodPost, "/default/state?ID=2", testState, nil, http.StatusOK)
+	expect(t, handler, MethodUnlock, "/default/state", `{"ID": "2"}`, nil, http.StatusOK)
+	expect(t, handler, MethodLock, "/default/state", `{"ID": "3"}`, nil, http.StatusOK)
+}
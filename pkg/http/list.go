@@ -0,0 +1,47 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	authenticationapi "k8s.io/api/authentication/v1"
+)
+
+// handleList serves the listing endpoint:
+//
+//	GET /<namespace>/  lists the states in the namespace
+func (h *handler) handleList(r route, userInfo authenticationapi.UserInfo, req *http.Request,
+	w http.ResponseWriter) {
+	err := h.checkAccess(r.store.Resource(), "list", r.key, userInfo)
+	if err != nil {
+		log.Printf("failed to check access to list %s: %v", r.store.Resource(), err)
+		handleAPIError(err, w)
+		return
+	}
+
+	states, err := r.store.List(r.key.Namespace)
+	if err != nil {
+		log.Printf("failed to list states in namespace %s: %v", r.key.Namespace, err)
+		h.handleStoreError(err, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(states)
+}
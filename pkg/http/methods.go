@@ -0,0 +1,83 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	"net/http"
+	"strings"
+)
+
+var (
+	readMethods  = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	stateMethods = []string{
+		http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete,
+		MethodLock, MethodUnlock, http.MethodOptions,
+	}
+	lockMethods = []string{
+		MethodLock, MethodUnlock, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions,
+	}
+	rollbackMethods = []string{http.MethodPost, http.MethodPut, http.MethodOptions}
+)
+
+// allowedMethods returns the methods allowed for the route, or nil if the route does not exist.
+func allowedMethods(r route) []string {
+	switch {
+	case r.key.Name == "":
+		return readMethods
+	case r.subresource == "":
+		return stateMethods
+	case r.subresource == subresourceLock:
+		if len(r.args) > 0 {
+			return nil
+		}
+		return lockMethods
+	case r.subresource == subresourceVersions && len(r.args) == 2:
+		return rollbackMethods
+	default:
+		return readMethods
+	}
+}
+
+// lockMethod returns the lock method equivalent to the method of a request to the lock subresource, allowing
+// Terraform's lock_method and unlock_method to be configured as e.g. PUT and DELETE.
+func lockMethod(method string) string {
+	switch method {
+	case http.MethodPost, http.MethodPut:
+		return MethodLock
+	case http.MethodDelete:
+		return MethodUnlock
+	}
+	return method
+}
+
+// checkMethod responds to OPTIONS requests, and to requests with methods that are not allowed with 405 Method Not
+// Allowed, returning false if the request has been handled.
+func checkMethod(allowed []string, req *http.Request, w http.ResponseWriter) bool {
+	if req.Method == http.MethodOptions {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		w.WriteHeader(http.StatusNoContent)
+		return false
+	}
+	for _, method := range allowed {
+		if method == req.Method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	return false
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	authorizationapi "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	authorizationv1 "k8s.io/client-go/kubernetes/typed/authorization/v1"
+
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/metrics"
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/storage"
+)
+
+// metricsHandler serves metrics to users authorized to get the request path as a non-resource URL.
+type metricsHandler struct {
+	next                http.Handler
+	authenticator       authenticator.Request
+	authorizationClient authorizationv1.SubjectAccessReviewInterface
+}
+
+// NewMetricsHandler returns a handler that serves requests with next if the user is authorized to get the request path
+// as a non-resource URL, e.g. by an RBAC rule granting get on the /metrics nonResourceURL, as required to scrape the
+// metrics of Kubernetes components.
+func NewMetricsHandler(
+	next http.Handler,
+	authenticator authenticator.Request,
+	authorizationClient authorizationv1.SubjectAccessReviewInterface,
+) http.Handler {
+	return &metricsHandler{next: next, authenticator: authenticator, authorizationClient: authorizationClient}
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, ok, err := authenticate(h.authenticator, req)
+	if err != nil {
+		log.Printf("failed to authenticate request: %v", err)
+		handleAPIError(err, w)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	sarSpec := subjectAccessReviewSpec(toUserInfo(resp.User))
+	sarSpec.NonResourceAttributes = &authorizationapi.NonResourceAttributes{Path: req.URL.Path, Verb: "get"}
+	sarResponse, err := reviewAccess(h.authorizationClient, &authorizationapi.SubjectAccessReview{Spec: sarSpec})
+	if err != nil {
+		log.Printf("failed to check authorization: %v", err)
+		handleAPIError(err, w)
+		return
+	}
+	if !sarResponse.Status.Allowed {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	h.next.ServeHTTP(w, req)
+}
+
+// NewLockCollector returns a collector exporting the age of the locks held on the states of all stores that implement
+// storage.LockLister, in all namespaces. Stores whose locks cannot be listed, e.g. because listing their resource is
+// forbidden, are skipped so that the locks of the other stores are still exported.
+func NewLockCollector(stores []storage.StateStore) prometheus.Collector {
+	return metrics.NewLockCollector(func() ([]metrics.Lock, error) {
+		var locks []metrics.Lock
+		for _, store := range stores {
+			lister, ok := store.(storage.LockLister)
+			if !ok {
+				continue
+			}
+			lockedStates, err := lister.ListLocks(metav1.NamespaceAll)
+			if err != nil {
+				log.Printf("failed to list locks of %s: %v", store.Resource(), err)
+				continue
+			}
+			for _, locked := range lockedStates {
+				locks = append(locks, metrics.Lock{
+					Resource:  store.Resource(),
+					Namespace: locked.Key.Namespace,
+					Name:      locked.Key.Name,
+					Workspace: locked.Key.Workspace,
+					Created:   locked.Lock.Created,
+				})
+			}
+		}
+		return locks, nil
+	})
+}
@@ -0,0 +1,279 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	authenticationapi "k8s.io/api/authentication/v1"
+	authorizationapi "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/kubernetes"
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/metrics"
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/storage"
+)
+
+// serve sends a request authenticated as user to handler, returning the response status code.
+func serve(handler http.Handler, user, method, path, body string) int {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.SetBasicAuth("terraform", user)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+// gather returns the metrics of the named metric family.
+func gather(t *testing.T, name string) []*dto.Metric {
+	t.Helper()
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()
+		}
+	}
+	return nil
+}
+
+// histogramCount returns the number of observations of the histogram with the specified label value, or of all
+// histograms of the family if the label value is empty.
+func histogramCount(t *testing.T, name, labelValue string) uint64 {
+	t.Helper()
+	var count uint64
+	for _, metric := range gather(t, name) {
+		if labelValue == "" {
+			count += metric.GetHistogram().GetSampleCount()
+			continue
+		}
+		for _, label := range metric.GetLabel() {
+			if label.GetValue() == labelValue {
+				count += metric.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return count
+}
+
+func TestRequestMetrics(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	requests := metrics.RequestsTotal.WithLabelValues("post", "200")
+	before := testutil.ToFloat64(requests)
+	durations := histogramCount(t, "tf_kubernetes_configmap_backend_http_request_duration_seconds", "post")
+	authentications := histogramCount(t, "tf_kubernetes_configmap_backend_authentication_duration_seconds", "")
+	originalSizes := histogramCount(t, "tf_kubernetes_configmap_backend_state_size_bytes", "original")
+	storedSizes := histogramCount(t, "tf_kubernetes_configmap_backend_state_size_bytes", "stored")
+
+	if code := serve(handler, "user", http.MethodPost, "/default/state", testState); code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+
+	if got := testutil.ToFloat64(requests); got != before+1 {
+		t.Errorf("expected %v requests, got %v", before+1, got)
+	}
+	if got := histogramCount(t, "tf_kubernetes_configmap_backend_http_request_duration_seconds", "post"); got != durations+1 {
+		t.Errorf("expected %d request durations, got %d", durations+1, got)
+	}
+	if got := histogramCount(t, "tf_kubernetes_configmap_backend_state_size_bytes", "original"); got != originalSizes+1 {
+		t.Errorf("expected %d original state sizes, got %d", originalSizes+1, got)
+	}
+	if got := histogramCount(t, "tf_kubernetes_configmap_backend_state_size_bytes", "stored"); got != storedSizes+1 {
+		t.Errorf("expected %d stored state sizes, got %d", storedSizes+1, got)
+	}
+	if metrics := gather(t, "tf_kubernetes_configmap_backend_authentication_duration_seconds"); len(metrics) != 1 ||
+		metrics[0].GetHistogram().GetSampleCount() != authentications+1 {
+		t.Errorf("expected %d authentications, got %v", authentications+1, metrics)
+	}
+}
+
+func TestRequestMethodMetrics(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	requests := metrics.RequestsTotal.WithLabelValues("other", "405")
+	before := testutil.ToFloat64(requests)
+
+	for _, method := range []string{"PROPFIND", "BREW"} {
+		if code := serve(handler, "user", method, "/default/state", ""); code != http.StatusMethodNotAllowed {
+			t.Fatalf("expected status %d, got %d", http.StatusMethodNotAllowed, code)
+		}
+	}
+
+	if got := testutil.ToFloat64(requests); got != before+2 {
+		t.Errorf("expected %v requests, got %v", before+2, got)
+	}
+	for _, metric := range gather(t, "tf_kubernetes_configmap_backend_http_requests_total") {
+		for _, label := range metric.GetLabel() {
+			if label.GetName() == "method" && (label.GetValue() == "propfind" || label.GetValue() == "brew") {
+				t.Errorf("expected unknown methods to be recorded as other, got %s", label.GetValue())
+			}
+		}
+	}
+}
+
+func TestMetricsAuthorization(t *testing.T) {
+	_, client := newTestHandler(t)
+	client.PrependReactor("create", "subjectaccessreviews",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			review := action.(k8stesting.CreateAction).GetObject().(*authorizationapi.SubjectAccessReview)
+			attributes := review.Spec.NonResourceAttributes
+			review.Status.Allowed = review.Spec.User == "prometheus" && attributes != nil &&
+				attributes.Path == "/metrics" && attributes.Verb == "get"
+			return true, review, nil
+		})
+	authn := kubernetes.NewBasicAuthAuthenticator(
+		kubernetes.NewTokenReviewAuthenticator(client.AuthenticationV1().TokenReviews()))
+	handler := NewMetricsHandler(metrics.Handler(), authn, client.AuthorizationV1().SubjectAccessReviews())
+
+	for _, c := range []struct {
+		user string
+		code int
+	}{
+		{user: "", code: http.StatusUnauthorized},
+		{user: "invalid", code: http.StatusUnauthorized},
+		{user: "user", code: http.StatusForbidden},
+		{user: "prometheus", code: http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if c.user != "" {
+			req.SetBasicAuth("terraform", c.user)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != c.code {
+			t.Errorf("expected status %d for user %q, got %d", c.code, c.user, rec.Code)
+		}
+		if c.code == http.StatusOK && !strings.Contains(rec.Body.String(), "tf_kubernetes_configmap_backend_") {
+			t.Errorf("expected metrics, got %q", rec.Body.String())
+		}
+	}
+}
+
+func TestAuthenticationErrorMetrics(t *testing.T) {
+	handler, client := newTestHandler(t)
+	client.PrependReactor("create", "tokenreviews",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, &authenticationapi.TokenReview{}, errors.New("unavailable")
+		})
+	before := testutil.ToFloat64(metrics.AuthenticationErrorsTotal)
+
+	if code := serve(handler, "user", http.MethodGet, "/default/state", ""); code != http.StatusInternalServerError {
+		t.Fatalf("expected status %d, got %d", http.StatusInternalServerError, code)
+	}
+
+	if got := testutil.ToFloat64(metrics.AuthenticationErrorsTotal); got != before+1 {
+		t.Errorf("expected %v authentication errors, got %v", before+1, got)
+	}
+}
+
+func TestLockMetrics(t *testing.T) {
+	for _, lockMode := range storage.LockModes {
+		t.Run(lockMode, func(t *testing.T) {
+			handler, client := newTestHandlerWithOptions(t, storage.Options{LockMode: lockMode}, Options{})
+			contention := testutil.ToFloat64(metrics.LockContentionTotal)
+
+			// Lock ages are read from storage, so the stores of another replica export locks acquired through this one.
+			var stores []storage.StateStore
+			for _, resource := range storage.Resources {
+				store, err := storage.NewKubernetesStore(client, resource, storage.Options{LockMode: lockMode})
+				if err != nil {
+					t.Fatal(err)
+				}
+				stores = append(stores, store)
+			}
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(NewLockCollector(stores))
+
+			// Locks of stores that cannot be listed are skipped.
+			client.PrependReactor("list", "secrets",
+				func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, apierrors.NewForbidden(action.GetResource().GroupResource(), "", errors.New("denied"))
+				})
+			lockAges := func() map[string]float64 {
+				families, err := registry.Gather()
+				if err != nil {
+					t.Fatal(err)
+				}
+				ages := map[string]float64{}
+				for _, family := range families {
+					for _, metric := range family.GetMetric() {
+						labels := map[string]string{}
+						for _, label := range metric.GetLabel() {
+							labels[label.GetName()] = label.GetValue()
+						}
+						key := []string{labels["resource"], labels["namespace"], labels["name"], labels["workspace"]}
+						ages[strings.Join(key, "/")] = metric.GetGauge().GetValue()
+					}
+				}
+				return ages
+			}
+
+			if code := serve(handler, "user", MethodLock, "/default/locked/dev", `{"ID": "1"}`); code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+			}
+			ages := lockAges()
+			if age, ok := ages["configmaps/default/locked/dev"]; !ok || age < 0 || age > 60 {
+				t.Errorf("expected lock age of locked state, got %v", ages)
+			}
+
+			code := serve(handler, "other", MethodLock, "/default/locked/dev", `{"ID": "2"}`)
+			if code != http.StatusLocked {
+				t.Fatalf("expected status %d, got %d", http.StatusLocked, code)
+			}
+			if got := testutil.ToFloat64(metrics.LockContentionTotal); got != contention+1 {
+				t.Errorf("expected %v lock contentions, got %v", contention+1, got)
+			}
+
+			code = serve(handler, "user", MethodUnlock, "/default/locked/dev", `{"ID": "1"}`)
+			if code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+			}
+			if ages := lockAges(); len(ages) != 0 {
+				t.Errorf("expected no lock ages once unlocked, got %v", ages)
+			}
+		})
+	}
+}
+
+func TestKubernetesAPIErrorMetrics(t *testing.T) {
+	handler, client := newTestHandler(t)
+	client.PrependReactor("get", "configmaps",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, apierrors.NewInternalError(errors.New("unavailable"))
+		})
+	apiErrors := metrics.KubernetesAPIErrorsTotal.WithLabelValues(
+		storage.ResourceConfigMaps, "get", string(metav1.StatusReasonInternalError))
+	before := testutil.ToFloat64(apiErrors)
+
+	if code := serve(handler, "user", http.MethodGet, "/default/state", ""); code != http.StatusInternalServerError {
+		t.Fatalf("expected status %d, got %d", http.StatusInternalServerError, code)
+	}
+
+	if got := testutil.ToFloat64(apiErrors); got != before+1 {
+		t.Errorf("expected %v Kubernetes API errors, got %v", before+1, got)
+	}
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	authenticationapi "k8s.io/api/authentication/v1"
+
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/storage"
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/tfstate"
+)
+
+// handleOutputs serves the outputs endpoint, authorized by get access to the outputs subresource rather than to the
+// state itself:
+//
+//	GET /<namespace>/<name>/outputs  returns a state containing only the outputs of the state
+func (h *handler) handleOutputs(r route, userInfo authenticationapi.UserInfo, req *http.Request,
+	w http.ResponseWriter) {
+	if len(r.args) > 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err := h.checkSubresourceAccess(r.store.Resource(), subresourceOutputs, "get", r.key, userInfo)
+	if err != nil {
+		log.Printf("failed to check access to get %s/%s: %v", r.store.Resource(), subresourceOutputs, err)
+		handleAPIError(err, w)
+		return
+	}
+
+	state, err := r.store.Get(r.key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("failed to get state %s: %v", r.key, err)
+		h.handleStoreError(err, w)
+		return
+	}
+	if state.Open == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	stored, err := state.Open()
+	if err != nil {
+		log.Printf("failed to read Terraform state: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to read Terraform state: %s", err)
+		return
+	}
+	defer stored.Close()
+	outputs, err := tfstate.ReadOutputs(stored)
+	if err != nil {
+		log.Printf("failed to read outputs of state %s: %v", r.key, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to read Terraform state outputs: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(outputs)
+}
@@ -0,0 +1,378 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/storage"
+)
+
+// The tests in this file check conformance with the Terraform http backend protocol, as implemented by
+// https://github.com/hashicorp/terraform/blob/master/backend/remote-state/http/client.go.
+
+// request sends a request authenticated as user to handler with the specified headers, returning the response.
+func request(t *testing.T, handler http.Handler, user, method, path, body string,
+	header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if user != "" {
+		req.SetBasicAuth("terraform", user)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// expect sends a request as with request, failing the test if the response does not have the expected status.
+func expect(t *testing.T, handler http.Handler, method, path, body string, header map[string]string,
+	status int) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := request(t, handler, "user", method, path, body, header)
+	if rec.Code != status {
+		t.Fatalf("%s %s: expected status %d, got %d: %s", method, path, status, rec.Code, rec.Body.String())
+	}
+	return rec
+}
+
+func TestGetMissingState(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	expect(t, handler, http.MethodGet, "/default/state", "", nil, http.StatusNotFound)
+	expect(t, handler, http.MethodHead, "/default/state", "", nil, http.StatusNotFound)
+}
+
+func TestGetUnwrittenState(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	expect(t, handler, MethodLock, "/default/state", `{"ID": "1"}`, nil, http.StatusOK)
+
+	rec := expect(t, handler, http.MethodGet, "/default/state", "", nil, http.StatusNoContent)
+	if rec.Body.Len() != 0 {
+		t.Errorf("expected empty body, got %q", rec.Body.String())
+	}
+}
+
+func TestGetState(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	expect(t, handler, http.MethodPost, "/default/state", testState, nil, http.StatusOK)
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		rec := expect(t, handler, method, "/default/state", "", nil, http.StatusOK)
+		if got := rec.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("%s: expected Content-Type application/json, got %q", method, got)
+		}
+		if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(len(testState)) {
+			t.Errorf("%s: expected Content-Length %d, got %q", method, len(testState), got)
+		}
+		if rec.Header().Get("ETag") == "" {
+			t.Errorf("%s: expected ETag", method)
+		}
+		expected := testState
+		if method == http.MethodHead {
+			expected = ""
+		}
+		if got := rec.Body.String(); got != expected {
+			t.Errorf("%s: expected body %q, got %q", method, expected, got)
+		}
+	}
+}
+
+func TestGetEmptyState(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	expect(t, handler, http.MethodPost, "/default/state", "", nil, http.StatusOK)
+
+	rec := expect(t, handler, http.MethodGet, "/default/state", "", nil, http.StatusOK)
+	if got := rec.Header().Get("Content-Length"); got != "0" {
+		t.Errorf("expected Content-Length 0, got %q", got)
+	}
+}
+
+func TestPutState(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	expect(t, handler, http.MethodPut, "/default/state", testState, nil, http.StatusOK)
+
+	rec := expect(t, handler, http.MethodGet, "/default/state", "", nil, http.StatusOK)
+	if got := rec.Body.String(); got != testState {
+		t.Errorf("expected body %q, got %q", testState, got)
+	}
+}
+
+func TestDeleteState(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	expect(t, handler, http.MethodPost, "/default/state", testState, nil, http.StatusOK)
+	expect(t, handler, http.MethodDelete, "/default/state", "", nil, http.StatusOK)
+	expect(t, handler, http.MethodGet, "/default/state", "", nil, http.StatusNotFound)
+}
+
+func TestInvalidKey(t *testing.T) {
+	handler, client := newTestHandler(t)
+	long := strings.Repeat("a", 190)
+	for _, path := range []string{"/default/" + long, "/default/state/" + long, "/default/State"} {
+		rec := expect(t, handler, http.MethodPost, path, testState, nil, http.StatusBadRequest)
+		if !strings.Contains(rec.Body.String(), "invalid state key") {
+			t.Errorf("expected invalid state key error for %s, got %q", path, rec.Body.String())
+		}
+		expect(t, handler, MethodLock, path, `{"ID": "1"}`, nil, http.StatusBadRequest)
+	}
+
+	// States stored under keys that can no longer be written can still be read and deleted.
+	configMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: long, Namespace: "default"},
+		BinaryData: map[string][]byte{"tfstate": []byte(testState)},
+	}
+	if _, err := client.CoreV1().ConfigMaps("default").Create(configMap); err != nil {
+		t.Fatal(err)
+	}
+	rec := expect(t, handler, http.MethodGet, "/default/"+long, "", nil, http.StatusOK)
+	if got := rec.Body.String(); got != testState {
+		t.Errorf("expected state %q, got %q", testState, got)
+	}
+	expect(t, handler, http.MethodDelete, "/default/"+long, "", nil, http.StatusOK)
+}
+
+func TestLongNames(t *testing.T) {
+	for _, lockMode := range storage.LockModes {
+		t.Run(lockMode, func(t *testing.T) {
+			options := storage.Options{LockMode: lockMode, HistoryLimit: 5, ChunkSize: 16}
+			handler, client := newTestHandlerWithOptions(t, options, Options{})
+			name, workspace := strings.Repeat("n", 70), strings.Repeat("w", 70)
+			path := "/default/" + name + "/" + workspace
+
+			expect(t, handler, MethodLock, path, `{"ID": "1"}`, nil, http.StatusOK)
+			expect(t, handler, http.MethodPost, path+"?ID=1", testState, nil, http.StatusOK)
+			expect(t, handler, http.MethodPost, path+"?ID=1", testState, nil, http.StatusOK)
+			expect(t, handler, MethodLock, path, `{"ID": "2"}`, nil, http.StatusLocked)
+			rec := expect(t, handler, http.MethodGet, path, "", nil, http.StatusOK)
+			if got := rec.Body.String(); got != testState {
+				t.Errorf("expected state %q, got %q", testState, got)
+			}
+			if versions := listVersions(t, handler, path); len(versions) != 1 {
+				t.Errorf("expected 1 version, got %+v", versions)
+			}
+
+			rec = expect(t, handler, http.MethodGet, "/default/"+name+"/workspaces", "", nil, http.StatusOK)
+			if got := strings.TrimSpace(rec.Body.String()); got != `["`+workspace+`"]` {
+				t.Errorf("expected workspace %s, got %s", workspace, got)
+			}
+			rec = expect(t, handler, http.MethodGet, "/default/", "", nil, http.StatusOK)
+			var states []storage.StateInfo
+			if err := json.Unmarshal(rec.Body.Bytes(), &states); err != nil {
+				t.Fatal(err)
+			}
+			if len(states) != 1 || states[0].Name != name || states[0].Workspace != workspace || states[0].Lock == nil {
+				t.Errorf("expected locked state %s workspace %s, got %+v", name, workspace, states)
+			}
+
+			configMaps, err := client.CoreV1().ConfigMaps("default").List(metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, configMap := range configMaps.Items {
+				for k, v := range configMap.Labels {
+					if len(v) > 63 {
+						t.Errorf("expected label values of at most 63 characters, got %s=%s on %s", k, v, configMap.Name)
+					}
+				}
+			}
+
+			expect(t, handler, MethodUnlock, path, `{"ID": "1"}`, nil, http.StatusOK)
+			expect(t, handler, http.MethodDelete, path, "", nil, http.StatusOK)
+			expect(t, handler, http.MethodGet, path, "", nil, http.StatusNotFound)
+		})
+	}
+}
+
+func TestLocking(t *testing.T) {
+	for _, c := range []struct {
+		name                     string
+		lockPath, lockMethod     string
+		unlockPath, unlockMethod string
+	}{
+		{"lock methods", "/default/state", MethodLock, "/default/state", MethodUnlock},
+		{"lock subpath", "/default/state/lock", http.MethodPut, "/default/state/lock", http.MethodDelete},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			handler, _ := newTestHandler(t)
+			expect(t, handler, c.lockMethod, c.lockPath, `{"ID": "1", "Who": "user"}`, nil, http.StatusOK)
+
+			rec := expect(t, handler, c.lockMethod, c.lockPath, `{"ID": "2"}`, nil, http.StatusLocked)
+			var lock storage.LockInfo
+			if err := json.Unmarshal(rec.Body.Bytes(), &lock); err != nil {
+				t.Fatalf("failed to decode lock info: %v", err)
+			}
+			if lock.ID != "1" || lock.Who != "user" {
+				t.Errorf("expected lock info of current lock, got %+v", lock)
+			}
+
+			expect(t, handler, http.MethodPost, "/default/state", testState, nil, http.StatusLocked)
+			expect(t, handler, http.MethodPost, "/default/state?ID=1", testState, nil, http.StatusOK)
+
+			expect(t, handler, c.unlockMethod, c.unlockPath, `{"ID": "2"}`, nil, http.StatusLocked)
+			expect(t, handler, c.unlockMethod, c.unlockPath, `{"ID": "1"}`, nil, http.StatusOK)
+			expect(t, handler, http.MethodPost, "/default/state", testState, nil, http.StatusOK)
+		})
+	}
+}
+
+func TestContentMD5(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	digest := md5.Sum([]byte(testState))
+	header := map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(digest[:])}
+
+	expect(t, handler, http.MethodPost, "/default/state", testState[:len(testState)/2], header, http.StatusBadRequest)
+	expect(t, handler, http.MethodGet, "/default/state", "", nil, http.StatusNotFound)
+
+	expect(t, handler, http.MethodPost, "/default/state", testState, header, http.StatusOK)
+	expect(t, handler, http.MethodGet, "/default/state", "", nil, http.StatusOK)
+
+	header["Content-MD5"] = "invalid"
+	expect(t, handler, http.MethodPost, "/default/state", testState, header, http.StatusBadRequest)
+}
+
+func TestConditionalRequests(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	expect(t, handler, http.MethodPost, "/default/state", testState, nil, http.StatusOK)
+	etag := expect(t, handler, http.MethodGet, "/default/state", "", nil, http.StatusOK).Header().Get("ETag")
+
+	rec := expect(t, handler, http.MethodGet, "/default/state", "", map[string]string{"If-None-Match": etag},
+		http.StatusNotModified)
+	if rec.Body.Len() != 0 {
+		t.Errorf("expected empty body, got %q", rec.Body.String())
+	}
+	expect(t, handler, http.MethodGet, "/default/state", "", map[string]string{"If-None-Match": `"other"`},
+		http.StatusOK)
+
+	updated := strings.Replace(testState, `"serial": 1`, `"serial": 2`, 1)
+	expect(t, handler, http.MethodPost, "/default/state", updated, map[string]string{"If-Match": `"other"`},
+		http.StatusPreconditionFailed)
+	expect(t, handler, http.MethodPost, "/default/state", updated, map[string]string{"If-Match": etag}, http.StatusOK)
+	expect(t, handler, http.MethodPost, "/default/state", updated, map[string]string{"If-Match": etag},
+		http.StatusPreconditionFailed)
+}
+
+func TestMethods(t *testing.T) {
+	handler, _ := newTestHandler(t)
+
+	rec := expect(t, handler, http.MethodPatch, "/default/state", "", nil, http.StatusMethodNotAllowed)
+	allow := rec.Header().Get("Allow")
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, MethodLock, MethodUnlock} {
+		if !strings.Contains(allow, method) {
+			t.Errorf("expected %s in Allow header %q", method, allow)
+		}
+	}
+
+	rec = expect(t, handler, http.MethodOptions, "/default/state", "", nil, http.StatusNoContent)
+	if got := rec.Header().Get("Allow"); got != allow {
+		t.Errorf("expected Allow header %q, got %q", allow, got)
+	}
+
+	expect(t, handler, http.MethodGet, "/default/state/lock", "", nil, http.StatusMethodNotAllowed)
+}
+
+func TestUnauthenticated(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	rec := request(t, handler, "", http.MethodGet, "/default/state", "", nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+	if rec.Header().Get("WWW-Authenticate") == "" {
+		t.Error("expected WWW-Authenticate header")
+	}
+}
+
+func TestMaxRequestSize(t *testing.T) {
+	handler, _ := newTestHandlerWithOptions(t, storage.Options{}, Options{MaxRequestSize: int64(len(testState))})
+	expect(t, handler, http.MethodPost, "/default/state", testState, nil, http.StatusOK)
+
+	rec := expect(t, handler, http.MethodPost, "/default/state", testState+" ", nil, http.StatusRequestEntityTooLarge)
+	want := "request body exceeds the maximum size of " + strconv.Itoa(len(testState)) + " bytes"
+	if rec.Body.String() != want {
+		t.Errorf("expected %q, got %q", want, rec.Body.String())
+	}
+	rec = expect(t, handler, http.MethodGet, "/default/state", "", nil, http.StatusOK)
+	if got := rec.Body.String(); got != testState {
+		t.Errorf("expected state %q, got %q", testState, got)
+	}
+}
+
+func TestCorruptState(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		state string
+	}{
+		{name: "small", state: testState},
+		{name: "large", state: `{"version": 4, "serial": 1, "lineage": "test", "outputs": {"value": {"value": "` +
+			strings.Repeat("x", 128*1024) + `"}}}`},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			options := storage.Options{Compression: storage.CompressionNone, ChunkSize: 16 * 1024}
+			handler, client := newTestHandlerWithOptions(t, options, Options{})
+			expect(t, handler, http.MethodPost, "/default/state", c.state, nil, http.StatusOK)
+
+			configMap, err := client.CoreV1().ConfigMaps("default").Get("state", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			configMap.Annotations["tf-kubernetes-configmap-backend.jimmidyson.github.com/checksum"] = "sha256:0000"
+			if _, err := client.CoreV1().ConfigMaps("default").Update(configMap); err != nil {
+				t.Fatal(err)
+			}
+
+			server := httptest.NewServer(handler)
+			defer server.Close()
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/default/state", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.SetBasicAuth("terraform", "user")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+
+			// Corrupt state is never returned in full with a successful status: it is rejected before the response
+			// starts if possible, and the response is aborted otherwise.
+			if resp.StatusCode == http.StatusOK {
+				if err == nil || len(body) >= len(c.state) {
+					t.Errorf("expected aborted response, got %d of %d bytes and error %v", len(body), len(c.state), err)
+				}
+				return
+			}
+			if resp.StatusCode != http.StatusInternalServerError || !strings.Contains(string(body), "corrupt") {
+				t.Errorf("expected corrupt state error, got %d: %s", resp.StatusCode, body)
+			}
+			if c.name == "large" {
+				t.Errorf("expected response of large state to be aborted, got %d", resp.StatusCode)
+			}
+		})
+	}
+}
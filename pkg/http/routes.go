@@ -0,0 +1,116 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/storage"
+)
+
+const (
+	subresourceVersions   = "versions"
+	subresourceWorkspaces = "workspaces"
+	subresourceOutputs    = "outputs"
+	subresourceLock       = "lock"
+)
+
+// route is a parsed request path of the form
+// [/<resource>]/<namespace>/<name>[/<workspace>][/<subresource>[/<args>...]], or [/<resource>]/<namespace>/ to list
+// the states in the namespace, in which case the key has no name. A first segment naming a storage resource is always
+// the resource, so namespaces named after a storage resource can only be addressed with the resource, e.g.
+// /configmaps/secrets/<name>. Workspaces named after a subresource cannot be addressed, so are rejected by validate.
+type route struct {
+	store       storage.StateStore
+	key         storage.Key
+	subresource string
+	args        []string
+}
+
+func isSubresource(s string) bool {
+	switch s {
+	case subresourceVersions, subresourceWorkspaces, subresourceOutputs, subresourceLock:
+		return true
+	}
+	return false
+}
+
+// parseRoute parses the request path, returning false if the path is not valid. The workspace can alternatively be
+// specified with the workspace query parameter, and the outputs subresource with the outputs query parameter.
+func (h *handler) parseRoute(u *url.URL) (route, bool) {
+	segments := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+
+	// Paths can optionally be prefixed with the resource of a store to override the default store.
+	r := route{store: h.stores[0]}
+	for _, resource := range storage.Resources {
+		if resource != segments[0] {
+			continue
+		}
+		r.store = nil
+		for _, s := range h.stores {
+			if s.Resource() == resource {
+				r.store = s
+			}
+		}
+		if r.store == nil {
+			return route{}, false
+		}
+		segments = segments[1:]
+		break
+	}
+
+	if len(segments) == 2 && segments[0] != "" && segments[1] == "" {
+		r.key = storage.Key{Namespace: segments[0]}
+		return r, true
+	}
+	if len(segments) < 2 || segments[0] == "" || segments[1] == "" {
+		return route{}, false
+	}
+	r.key = storage.Key{Namespace: segments[0], Name: segments[1], Workspace: u.Query().Get("workspace")}
+	segments = segments[2:]
+
+	if len(segments) > 0 && !isSubresource(segments[0]) {
+		if segments[0] == "" {
+			return route{}, false
+		}
+		r.key.Workspace = segments[0]
+		segments = segments[1:]
+	}
+
+	if len(segments) > 0 {
+		if !isSubresource(segments[0]) {
+			return route{}, false
+		}
+		r.subresource = segments[0]
+		r.args = segments[1:]
+	} else if _, ok := u.Query()[subresourceOutputs]; ok {
+		r.subresource = subresourceOutputs
+	}
+
+	return r, true
+}
+
+// validate returns an error wrapping storage.ErrInvalidKey if the workspace of the route is named after a subresource
+// and so could not be addressed by path.
+func (r route) validate() error {
+	if isSubresource(r.key.Workspace) {
+		return fmt.Errorf("%w %s: workspace %q is reserved", storage.ErrInvalidKey, r.key, r.key.Workspace)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/storage"
+)
+
+func TestParseRoute(t *testing.T) {
+	h := &handler{}
+	for _, resource := range storage.Resources {
+		store, err := storage.NewKubernetesStore(fake.NewSimpleClientset(), resource, storage.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.stores = append(h.stores, store)
+	}
+
+	for _, c := range []struct {
+		path        string
+		resource    string
+		key         storage.Key
+		subresource string
+		invalid     bool
+	}{
+		{path: "/ns/", resource: "configmaps", key: storage.Key{Namespace: "ns"}},
+		{path: "/ns/state", resource: "configmaps", key: storage.Key{Namespace: "ns", Name: "state"}},
+		{path: "/ns/state/ws", resource: "configmaps", key: storage.Key{Namespace: "ns", Name: "state", Workspace: "ws"}},
+		{path: "/ns/state?workspace=ws", resource: "configmaps",
+			key: storage.Key{Namespace: "ns", Name: "state", Workspace: "ws"}},
+		{path: "/ns/state/ws/versions", resource: "configmaps",
+			key: storage.Key{Namespace: "ns", Name: "state", Workspace: "ws"}, subresource: subresourceVersions},
+		{path: "/ns/state/lock", resource: "configmaps",
+			key: storage.Key{Namespace: "ns", Name: "state"}, subresource: subresourceLock},
+		{path: "/secrets/ns/", resource: "secrets", key: storage.Key{Namespace: "ns"}},
+		{path: "/secrets/ns/state", resource: "secrets", key: storage.Key{Namespace: "ns", Name: "state"}},
+		{path: "/configmaps/ns/state/ws", resource: "configmaps",
+			key: storage.Key{Namespace: "ns", Name: "state", Workspace: "ws"}},
+		// The first segment is always the resource if it names one, regardless of the number of segments.
+		{path: "/configmaps/secrets/state", resource: "configmaps", key: storage.Key{Namespace: "secrets", Name: "state"}},
+		{path: "/secrets/secrets/state/ws", resource: "secrets",
+			key: storage.Key{Namespace: "secrets", Name: "state", Workspace: "ws"}},
+		{path: "/secrets/configmaps/", resource: "secrets", key: storage.Key{Namespace: "configmaps"}},
+		{path: "/secrets/state", invalid: true},
+		{path: "/configmaps/", invalid: true},
+		{path: "/ns/state/ws/other", invalid: true},
+		{path: "/ns//ws", invalid: true},
+	} {
+		u, err := url.Parse(c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, ok := h.parseRoute(u)
+		if ok == c.invalid {
+			t.Errorf("%s: expected valid %t, got %t", c.path, !c.invalid, ok)
+			continue
+		}
+		if c.invalid {
+			continue
+		}
+		if r.store.Resource() != c.resource || r.key != c.key || r.subresource != c.subresource {
+			t.Errorf("%s: expected %s %+v %q, got %s %+v %q", c.path, c.resource, c.key, c.subresource,
+				r.store.Resource(), r.key, r.subresource)
+		}
+	}
+}
+
+func TestReservedWorkspaces(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	for _, workspace := range []string{
+		subresourceLock, subresourceOutputs, subresourceVersions, subresourceWorkspaces,
+	} {
+		rec := expect(t, handler, http.MethodPost, "/default/state?workspace="+workspace, testState, nil,
+			http.StatusBadRequest)
+		if !strings.Contains(rec.Body.String(), "reserved") {
+			t.Errorf("expected reserved workspace error for %s, got %q", workspace, rec.Body.String())
+		}
+	}
+	expect(t, handler, http.MethodPost, "/default/state?workspace=ws", testState, nil, http.StatusOK)
+	rec := expect(t, handler, http.MethodGet, "/default/state/ws", "", nil, http.StatusOK)
+	if got := rec.Body.String(); got != testState {
+		t.Errorf("expected state %q, got %q", testState, got)
+	}
+}
+
+func TestWorkspaceObjectNameCollision(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	expect(t, handler, http.MethodPost, "/default/foo/bar", testState, nil, http.StatusOK)
+
+	// The object storing workspace bar of foo cannot be addressed as a state of its own.
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodDelete, MethodLock} {
+		rec := expect(t, handler, method, "/default/foo-workspace-bar", testState, nil, http.StatusBadRequest)
+		if !strings.Contains(rec.Body.String(), "invalid state key") {
+			t.Errorf("%s: expected invalid state key error, got %q", method, rec.Body.String())
+		}
+	}
+	expect(t, handler, http.MethodGet, "/default/foo-workspace-bar/outputs", "", nil, http.StatusBadRequest)
+	expect(t, handler, http.MethodGet, "/default/foo-workspace-bar?outputs", "", nil, http.StatusBadRequest)
+	rec := expect(t, handler, http.MethodGet, "/default/foo/bar", "", nil, http.StatusOK)
+	if got := rec.Body.String(); got != testState {
+		t.Errorf("expected state %q, got %q", testState, got)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	authenticationapi "k8s.io/api/authentication/v1"
+
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/storage"
+)
+
+// handleVersions serves the state history endpoints:
+//
+//	GET  /<namespace>/<name>/versions                      lists previous versions
+//	GET  /<namespace>/<name>/versions/<revision>           returns a previous version
+//	POST /<namespace>/<name>/versions/<revision>/rollback  replaces the state with a previous version
+//
+// The history of a deleted state is kept, so exists is false if the state has been deleted.
+func (h *handler) handleVersions(r route, exists bool, userInfo authenticationapi.UserInfo,
+	req *http.Request, w http.ResponseWriter) {
+	if len(r.args) == 0 {
+		versions, err := r.store.ListVersions(r.key)
+		if err != nil {
+			log.Printf("failed to list versions of state %s: %v", r.key, err)
+			h.handleStoreError(err, w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(versions)
+		return
+	}
+
+	revision, err := strconv.Atoi(r.args[0])
+	if err != nil || len(r.args) > 2 || (len(r.args) == 2 && r.args[1] != "rollback") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(r.args) == 1:
+		state, err := r.store.GetVersion(r.key, revision)
+		if err != nil {
+			log.Printf("failed to get version %d of state %s: %v", revision, r.key, err)
+			h.handleStoreError(err, w)
+			return
+		}
+		h.handleGET(state, req, w)
+	default:
+		h.handleRollback(r, revision, exists, userInfo, req, w)
+	}
+}
+
+func (h *handler) handleRollback(r route, revision int, exists bool, userInfo authenticationapi.UserInfo,
+	req *http.Request, w http.ResponseWriter) {
+	// Rolling back a deleted state creates it again.
+	apiVerb := "update"
+	if !exists {
+		apiVerb = "create"
+	}
+	err := h.checkAccess(r.store.Resource(), apiVerb, r.key, userInfo)
+	if err != nil {
+		log.Printf("failed to check access to %s %s: %v", apiVerb, r.store.Resource(), err)
+		handleAPIError(err, w)
+		return
+	}
+
+	version, err := r.store.GetVersion(r.key, revision)
+	if err != nil {
+		log.Printf("failed to get version %d of state %s: %v", revision, r.key, err)
+		h.handleStoreError(err, w)
+		return
+	}
+	if version.Open == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	state, err := version.Open()
+	if err != nil {
+		log.Printf("failed to read version %d of state %s: %v", revision, r.key, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to read Terraform state: %s", err)
+		return
+	}
+	defer state.Close()
+
+	// Rolling back intentionally writes a state with a lower serial than the stored state.
+	putOptions := storage.PutOptions{LockID: req.URL.Query().Get("ID"), Force: true}
+	if err := r.store.Put(r.key, state, putOptions); err != nil {
+		log.Printf("failed to roll back state %s to version %d: %v", r.key, revision, err)
+		h.handleStoreError(err, w)
+	}
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/storage"
+)
+
+const (
+	labelKeyHistoryOf       = "tf-kubernetes-configmap-backend.jimmidyson.github.com/history-of"
+	labelKeyChunkOf         = "tf-kubernetes-configmap-backend.jimmidyson.github.com/chunk-of"
+	labelKeyChunkGeneration = "tf-kubernetes-configmap-backend.jimmidyson.github.com/chunk-generation"
+)
+
+// testStateSerial returns a Terraform state with the specified serial.
+func testStateSerial(serial int) string {
+	return fmt.Sprintf(`{"version": 4, "serial": %d, "lineage": "test", "outputs": {}}`, serial)
+}
+
+// listVersions returns the previous versions of the state at path.
+func listVersions(t *testing.T, handler http.Handler, path string) []storage.Version {
+	t.Helper()
+	rec := expect(t, handler, http.MethodGet, path+"/versions", "", nil, http.StatusOK)
+	var versions []storage.Version
+	if err := json.Unmarshal(rec.Body.Bytes(), &versions); err != nil {
+		t.Fatal(err)
+	}
+	return versions
+}
+
+func TestDeleteKeepsHistory(t *testing.T) {
+	handler, _ := newTestHandlerWithOptions(t, storage.Options{HistoryLimit: 5, ChunkSize: 16}, Options{})
+	expect(t, handler, http.MethodGet, "/default/state/versions", "", nil, http.StatusNotFound)
+
+	expect(t, handler, http.MethodPost, "/default/state", testStateSerial(1), nil, http.StatusOK)
+	expect(t, handler, http.MethodPost, "/default/state", testStateSerial(2), nil, http.StatusOK)
+	expect(t, handler, http.MethodDelete, "/default/state", "", nil, http.StatusOK)
+	expect(t, handler, http.MethodGet, "/default/state", "", nil, http.StatusNotFound)
+
+	versions := listVersions(t, handler, "/default/state")
+	if len(versions) != 2 || versions[0].Revision != 2 || versions[0].Serial != 2 || versions[1].Revision != 1 {
+		t.Fatalf("expected deleted state and its history to be kept, got %+v", versions)
+	}
+	rec := expect(t, handler, http.MethodGet, "/default/state/versions/2", "", nil, http.StatusOK)
+	if got := rec.Body.String(); got != testStateSerial(2) {
+		t.Errorf("expected deleted state %q, got %q", testStateSerial(2), got)
+	}
+
+	// Writing the state again continues from the revisions of its history rather than overwriting it.
+	expect(t, handler, http.MethodPost, "/default/state", testStateSerial(1), nil, http.StatusOK)
+	expect(t, handler, http.MethodPost, "/default/state", testStateSerial(3), nil, http.StatusOK)
+	versions = listVersions(t, handler, "/default/state")
+	if len(versions) != 3 || versions[0].Revision != 3 || versions[0].Serial != 1 {
+		t.Fatalf("expected revisions to continue after delete, got %+v", versions)
+	}
+	rec = expect(t, handler, http.MethodGet, "/default/state/versions/2", "", nil, http.StatusOK)
+	if got := rec.Body.String(); got != testStateSerial(2) {
+		t.Errorf("expected history of deleted state %q, got %q", testStateSerial(2), got)
+	}
+
+	// A deleted state can be restored by rolling back.
+	expect(t, handler, http.MethodDelete, "/default/state", "", nil, http.StatusOK)
+	expect(t, handler, http.MethodPost, "/default/state/versions/2/rollback", "", nil, http.StatusOK)
+	rec = expect(t, handler, http.MethodGet, "/default/state", "", nil, http.StatusOK)
+	if got := rec.Body.String(); got != testStateSerial(2) {
+		t.Errorf("expected rolled back state %q, got %q", testStateSerial(2), got)
+	}
+}
+
+func TestInternalObjectsAreNotStates(t *testing.T) {
+	handler, client := newTestHandlerWithOptions(t, storage.Options{HistoryLimit: 5, ChunkSize: 16}, Options{})
+	expect(t, handler, http.MethodPost, "/default/state", testStateSerial(1), nil, http.StatusOK)
+	expect(t, handler, http.MethodPost, "/default/state", testStateSerial(2), nil, http.StatusOK)
+
+	configMaps, err := client.CoreV1().ConfigMaps("default").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal := 0
+	for _, configMap := range configMaps.Items {
+		if configMap.Name == "state" {
+			continue
+		}
+		internal++
+		path := "/default/" + configMap.Name
+		for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodDelete, MethodLock} {
+			expect(t, handler, method, path, testStateSerial(3), nil, http.StatusBadRequest)
+		}
+		expect(t, handler, http.MethodGet, path+"/versions", "", nil, http.StatusBadRequest)
+	}
+	if internal == 0 {
+		t.Fatal("expected history and chunk objects")
+	}
+
+	rec := expect(t, handler, http.MethodGet, "/default/state", "", nil, http.StatusOK)
+	if got := rec.Body.String(); got != testStateSerial(2) {
+		t.Errorf("expected state %q, got %q", testStateSerial(2), got)
+	}
+	expect(t, handler, http.MethodGet, "/default/state/versions/1", "", nil, http.StatusOK)
+}
+
+// revisions returns the revisions of versions, most recent first.
+func revisions(versions []storage.Version) []int {
+	revisions := make([]int, 0, len(versions))
+	for _, version := range versions {
+		revisions = append(revisions, version.Revision)
+	}
+	return revisions
+}
+
+func TestHistoryLimit(t *testing.T) {
+	handler, client := newTestHandlerWithOptions(t, storage.Options{HistoryLimit: 2, ChunkSize: 16}, Options{})
+	for serial := 1; serial <= 5; serial++ {
+		expect(t, handler, http.MethodPost, "/default/state", testStateSerial(serial), nil, http.StatusOK)
+	}
+
+	if got := revisions(listVersions(t, handler, "/default/state")); fmt.Sprint(got) != fmt.Sprint([]int{4, 3}) {
+		t.Errorf("expected revisions [4 3], got %v", got)
+	}
+	expect(t, handler, http.MethodGet, "/default/state/versions/2", "", nil, http.StatusNotFound)
+	expect(t, handler, http.MethodGet, "/default/state/versions/1", "", nil, http.StatusNotFound)
+	rec := expect(t, handler, http.MethodGet, "/default/state/versions/3", "", nil, http.StatusOK)
+	if got := rec.Body.String(); got != testStateSerial(3) {
+		t.Errorf("expected version 3 %q, got %q", testStateSerial(3), got)
+	}
+
+	// Only the chunks of the current state and of the kept versions remain.
+	listOptions := metav1.ListOptions{LabelSelector: labelKeyChunkOf + "=state"}
+	chunks, err := client.CoreV1().ConfigMaps("default").List(listOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks.Items) == 0 {
+		t.Fatal("expected chunked state")
+	}
+	for _, chunk := range chunks.Items {
+		generation, _ := strconv.Atoi(chunk.Labels[labelKeyChunkGeneration])
+		if generation < 3 {
+			t.Errorf("expected chunk %s of pruned generation %d to be deleted", chunk.Name, generation)
+		}
+	}
+}
+
+func TestHistoryMaxAge(t *testing.T) {
+	handler, client := newTestHandlerWithOptions(t,
+		storage.Options{HistoryLimit: 5, HistoryMaxAge: time.Hour, ChunkSize: 16}, Options{})
+	for serial := 1; serial <= 3; serial++ {
+		expect(t, handler, http.MethodPost, "/default/state", testStateSerial(serial), nil, http.StatusOK)
+	}
+
+	// Age the oldest version beyond the maximum age.
+	history, err := client.CoreV1().ConfigMaps("default").Get("state-history-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if history.Labels[labelKeyHistoryOf] != "state" {
+		t.Fatalf("expected history of state, got labels %v", history.Labels)
+	}
+	history.CreationTimestamp = metav1.NewTime(time.Now().Add(-2 * time.Hour))
+	if _, err := client.CoreV1().ConfigMaps("default").Update(history); err != nil {
+		t.Fatal(err)
+	}
+
+	expect(t, handler, http.MethodPost, "/default/state", testStateSerial(4), nil, http.StatusOK)
+	if got := revisions(listVersions(t, handler, "/default/state")); fmt.Sprint(got) != fmt.Sprint([]int{3, 2}) {
+		t.Errorf("expected revisions [3 2], got %v", got)
+	}
+	expect(t, handler, http.MethodGet, "/default/state/versions/1", "", nil, http.StatusNotFound)
+}
+
+func TestRollback(t *testing.T) {
+	handler, _ := newTestHandlerWithOptions(t, storage.Options{HistoryLimit: 5}, Options{})
+	for serial := 1; serial <= 3; serial++ {
+		expect(t, handler, http.MethodPost, "/default/state", testStateSerial(serial), nil, http.StatusOK)
+	}
+
+	// Rolling back writes the previous version over a state with a higher serial, keeping the replaced state as a
+	// version in turn.
+	expect(t, handler, http.MethodPost, "/default/state/versions/1/rollback", "", nil, http.StatusOK)
+	rec := expect(t, handler, http.MethodGet, "/default/state", "", nil, http.StatusOK)
+	if got := rec.Body.String(); got != testStateSerial(1) {
+		t.Errorf("expected rolled back state %q, got %q", testStateSerial(1), got)
+	}
+	versions := listVersions(t, handler, "/default/state")
+	if len(versions) != 3 || versions[0].Revision != 3 || versions[0].Serial != 3 {
+		t.Fatalf("expected replaced state to be kept as revision 3, got %+v", versions)
+	}
+
+	expect(t, handler, http.MethodPost, "/default/state/versions/9/rollback", "", nil, http.StatusNotFound)
+	expect(t, handler, http.MethodPost, "/default/state/versions/invalid/rollback", "", nil, http.StatusNotFound)
+
+	// Rolling back a locked state requires the lock ID.
+	expect(t, handler, MethodLock, "/default/state", `{"ID": "1"}`, nil, http.StatusOK)
+	expect(t, handler, http.MethodPost, "/default/state/versions/3/rollback", "", nil, http.StatusLocked)
+	expect(t, handler, http.MethodPost, "/default/state/versions/3/rollback?ID=2", "", nil, http.StatusLocked)
+	expect(t, handler, http.MethodPost, "/default/state/versions/3/rollback?ID=1", "", nil, http.StatusOK)
+	rec = expect(t, handler, http.MethodGet, "/default/state", "", nil, http.StatusOK)
+	if got := rec.Body.String(); got != testStateSerial(3) {
+		t.Errorf("expected rolled back state %q, got %q", testStateSerial(3), got)
+	}
+}
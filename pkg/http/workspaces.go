@@ -0,0 +1,42 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// handleWorkspaces serves the workspaces endpoint:
+//
+//	GET /<namespace>/<name>/workspaces  lists the workspaces of the state
+func (h *handler) handleWorkspaces(r route, req *http.Request, w http.ResponseWriter) {
+	if len(r.args) > 0 || r.key.Workspace != "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	workspaces, err := r.store.ListWorkspaces(r.key.Namespace, r.key.Name)
+	if err != nil {
+		log.Printf("failed to list workspaces of state %s: %v", r.key, err)
+		h.handleStoreError(err, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(workspaces)
+}
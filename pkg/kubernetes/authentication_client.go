@@ -26,7 +26,10 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-func AuthenticationClientFromOptions(s *options.DelegatingAuthenticationOptions) (v1.TokenReviewInterface, error) {
+// AuthenticationClientFromOptions returns a client for TokenReviews that caches reviews for the configured TTL, and
+// the uncached client for checks that must reach the API server.
+func AuthenticationClientFromOptions(
+	s *options.DelegatingAuthenticationOptions) (v1.TokenReviewInterface, v1.TokenReviewInterface, error) {
 	var clientConfig *rest.Config
 	var err error
 	if len(s.RemoteKubeConfigFile) > 0 {
@@ -38,7 +41,7 @@ func AuthenticationClientFromOptions(s *options.DelegatingAuthenticationOptions)
 		clientConfig, err = rest.InClusterConfig()
 	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to get delegated authentication kubeconfig: %v", err)
+		return nil, nil, fmt.Errorf("failed to get delegated authentication kubeconfig: %v", err)
 	}
 
 	// set high qps/burst limits since this will effectively limit API server responsiveness
@@ -47,7 +50,8 @@ func AuthenticationClientFromOptions(s *options.DelegatingAuthenticationOptions)
 
 	kc, err := kubernetes.NewForConfig(clientConfig)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return kc.AuthenticationV1().TokenReviews(), nil
+	tokenReviews := kc.AuthenticationV1().TokenReviews()
+	return newCachedTokenReviews(tokenReviews, s.CacheTTL), tokenReviews, nil
 }
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kubernetes
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	authenticationapi "k8s.io/api/authentication/v1"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/request/union"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/server"
+	"k8s.io/apiserver/pkg/server/options"
+	authenticationv1 "k8s.io/client-go/kubernetes/typed/authentication/v1"
+)
+
+// AuthenticatorFromOptions returns an authenticator for requests made with any of the credentials supported by the
+// delegating authentication options: front-proxy request headers, client certificates and bearer tokens. Terraform can
+// only send credentials via Basic authentication, so the password of Basic authentication headers is also
+// authenticated as a token using tokenReviews. The client CAs are added to servingInfo so that clients are asked for
+// certificates. Requests without credentials are not authenticated rather than authenticated as anonymous.
+func AuthenticatorFromOptions(s *options.DelegatingAuthenticationOptions, servingInfo *server.SecureServingInfo,
+	tokenReviews authenticationv1.TokenReviewInterface) (authenticator.Request, error) {
+	authenticationInfo := &server.AuthenticationInfo{}
+	if err := s.ApplyTo(authenticationInfo, servingInfo, nil); err != nil {
+		return nil, err
+	}
+	return &nonAnonymousAuthenticator{
+		Request: union.New(
+			NewBasicAuthAuthenticator(NewTokenReviewAuthenticator(tokenReviews)),
+			authenticationInfo.Authenticator,
+		),
+	}, nil
+}
+
+// nonAnonymousAuthenticator does not authenticate requests that are authenticated as the anonymous user.
+type nonAnonymousAuthenticator struct {
+	authenticator.Request
+}
+
+func (a *nonAnonymousAuthenticator) AuthenticateRequest(req *http.Request) (*authenticator.Response, bool, error) {
+	resp, ok, err := a.Request.AuthenticateRequest(req)
+	if !ok || err != nil || resp.User.GetName() == user.Anonymous {
+		return nil, false, err
+	}
+	return resp, true, nil
+}
+
+// basicAuthAuthenticator authenticates the password of Basic authentication headers as a token.
+type basicAuthAuthenticator struct {
+	auth authenticator.Token
+}
+
+// NewBasicAuthAuthenticator returns an authenticator that authenticates the password of Basic authentication headers
+// as a token with auth. The username is ignored.
+func NewBasicAuthAuthenticator(auth authenticator.Token) authenticator.Request {
+	return &basicAuthAuthenticator{auth: auth}
+}
+
+func (a *basicAuthAuthenticator) AuthenticateRequest(req *http.Request) (*authenticator.Response, bool, error) {
+	_, token, ok := req.BasicAuth()
+	if !ok || token == "" {
+		return nil, false, nil
+	}
+	return a.auth.AuthenticateToken(req.Context(), token)
+}
+
+// tokenReviewAuthenticator authenticates tokens with TokenReviews.
+type tokenReviewAuthenticator struct {
+	client authenticationv1.TokenReviewInterface
+}
+
+// NewTokenReviewAuthenticator returns an authenticator that authenticates tokens with TokenReviews created with client.
+func NewTokenReviewAuthenticator(client authenticationv1.TokenReviewInterface) authenticator.Token {
+	return &tokenReviewAuthenticator{client: client}
+}
+
+func (a *tokenReviewAuthenticator) AuthenticateToken(ctx context.Context,
+	token string) (*authenticator.Response, bool, error) {
+	review, err := a.client.CreateContext(ctx, &authenticationapi.TokenReview{
+		Spec: authenticationapi.TokenReviewSpec{Token: token},
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if !review.Status.Authenticated {
+		if review.Status.Error != "" {
+			log.Printf("token not authenticated: %s", review.Status.Error)
+		}
+		return nil, false, nil
+	}
+
+	extra := make(map[string][]string, len(review.Status.User.Extra))
+	for k, v := range review.Status.User.Extra {
+		extra[k] = v
+	}
+	return &authenticator.Response{
+		Audiences: review.Status.Audiences,
+		User: &user.DefaultInfo{
+			Name:   review.Status.User.Username,
+			UID:    review.Status.User.UID,
+			Groups: review.Status.User.Groups,
+			Extra:  extra,
+		},
+	}, true, nil
+}
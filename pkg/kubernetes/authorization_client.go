@@ -26,7 +26,10 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-func AuthorizationClientFromOptions(s *options.DelegatingAuthorizationOptions) (v1.SubjectAccessReviewInterface, error) {
+// AuthorizationClientFromOptions returns a client for SubjectAccessReviews that caches reviews for the configured TTLs,
+// and the uncached client for checks that must reach the API server.
+func AuthorizationClientFromOptions(
+	s *options.DelegatingAuthorizationOptions) (v1.SubjectAccessReviewInterface, v1.SubjectAccessReviewInterface, error) {
 	var clientConfig *rest.Config
 	var err error
 	if len(s.RemoteKubeConfigFile) > 0 {
@@ -38,7 +41,7 @@ func AuthorizationClientFromOptions(s *options.DelegatingAuthorizationOptions) (
 		clientConfig, err = rest.InClusterConfig()
 	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to get delegated authorization kubeconfig: %v", err)
+		return nil, nil, fmt.Errorf("failed to get delegated authorization kubeconfig: %v", err)
 	}
 
 	// set high qps/burst limits since this will effectively limit API server responsiveness
@@ -47,7 +50,8 @@ func AuthorizationClientFromOptions(s *options.DelegatingAuthorizationOptions) (
 
 	kc, err := kubernetes.NewForConfig(clientConfig)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return kc.AuthorizationV1().SubjectAccessReviews(), nil
+	sars := kc.AuthorizationV1().SubjectAccessReviews()
+	return newCachedSubjectAccessReviews(sars, s.AllowCacheTTL, s.DenyCacheTTL), sars, nil
 }
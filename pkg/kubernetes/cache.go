@@ -0,0 +1,139 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kubernetes
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	authenticationapi "k8s.io/api/authentication/v1"
+	authorizationapi "k8s.io/api/authorization/v1"
+	utilcache "k8s.io/apimachinery/pkg/util/cache"
+	authenticationv1 "k8s.io/client-go/kubernetes/typed/authentication/v1"
+	authorizationv1 "k8s.io/client-go/kubernetes/typed/authorization/v1"
+
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/metrics"
+)
+
+// reviewCacheSize is the maximum number of cached TokenReview and SubjectAccessReview responses.
+const reviewCacheSize = 1024
+
+// cachedTokenReviews caches TokenReview responses, keyed on a hash of the reviewed token and audiences so that tokens
+// are never held in memory longer than needed.
+type cachedTokenReviews struct {
+	authenticationv1.TokenReviewInterface
+	cache *utilcache.LRUExpireCache
+	ttl   time.Duration
+}
+
+// newCachedTokenReviews returns a client caching TokenReview responses of client for ttl. A zero ttl disables caching.
+func newCachedTokenReviews(client authenticationv1.TokenReviewInterface,
+	ttl time.Duration) authenticationv1.TokenReviewInterface {
+	if ttl <= 0 {
+		return client
+	}
+	return &cachedTokenReviews{
+		TokenReviewInterface: client,
+		cache:                utilcache.NewLRUExpireCache(reviewCacheSize),
+		ttl:                  ttl,
+	}
+}
+
+func (c *cachedTokenReviews) Create(
+	tokenReview *authenticationapi.TokenReview) (*authenticationapi.TokenReview, error) {
+	return c.CreateContext(context.Background(), tokenReview)
+}
+
+func (c *cachedTokenReviews) CreateContext(ctx context.Context,
+	tokenReview *authenticationapi.TokenReview) (*authenticationapi.TokenReview, error) {
+	key := hashKey(tokenReview.Spec)
+	if cached, ok := c.cache.Get(key); ok {
+		metrics.AuthenticationCacheRequestsTotal.WithLabelValues("hit").Inc()
+		return cached.(*authenticationapi.TokenReview).DeepCopy(), nil
+	}
+	metrics.AuthenticationCacheRequestsTotal.WithLabelValues("miss").Inc()
+
+	result, err := c.TokenReviewInterface.CreateContext(ctx, tokenReview)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.Add(key, result.DeepCopy(), c.ttl)
+	return result, nil
+}
+
+// cachedSubjectAccessReviews caches SubjectAccessReview responses, keyed on the reviewed user and the reviewed
+// resource or non-resource attributes, including the verb.
+type cachedSubjectAccessReviews struct {
+	authorizationv1.SubjectAccessReviewInterface
+	cache    *utilcache.LRUExpireCache
+	allowTTL time.Duration
+	denyTTL  time.Duration
+}
+
+// newCachedSubjectAccessReviews returns a client caching allowed SubjectAccessReview responses of client for allowTTL
+// and denied responses for denyTTL. A zero TTL disables caching of the respective responses.
+func newCachedSubjectAccessReviews(client authorizationv1.SubjectAccessReviewInterface,
+	allowTTL, denyTTL time.Duration) authorizationv1.SubjectAccessReviewInterface {
+	if allowTTL <= 0 && denyTTL <= 0 {
+		return client
+	}
+	return &cachedSubjectAccessReviews{
+		SubjectAccessReviewInterface: client,
+		cache:                        utilcache.NewLRUExpireCache(reviewCacheSize),
+		allowTTL:                     allowTTL,
+		denyTTL:                      denyTTL,
+	}
+}
+
+func (c *cachedSubjectAccessReviews) Create(
+	sar *authorizationapi.SubjectAccessReview) (*authorizationapi.SubjectAccessReview, error) {
+	return c.CreateContext(context.Background(), sar)
+}
+
+func (c *cachedSubjectAccessReviews) CreateContext(ctx context.Context,
+	sar *authorizationapi.SubjectAccessReview) (*authorizationapi.SubjectAccessReview, error) {
+	key := hashKey(sar.Spec)
+	if cached, ok := c.cache.Get(key); ok {
+		metrics.AuthorizationCacheRequestsTotal.WithLabelValues("hit").Inc()
+		return cached.(*authorizationapi.SubjectAccessReview).DeepCopy(), nil
+	}
+	metrics.AuthorizationCacheRequestsTotal.WithLabelValues("miss").Inc()
+
+	result, err := c.SubjectAccessReviewInterface.CreateContext(ctx, sar)
+	if err != nil {
+		return nil, err
+	}
+	ttl := c.denyTTL
+	if result.Status.Allowed {
+		ttl = c.allowTTL
+	}
+	if ttl > 0 {
+		c.cache.Add(key, result.DeepCopy(), ttl)
+	}
+	return result, nil
+}
+
+// hashKey returns a cache key for a review spec. Specs are JSON encoded, which sorts map keys, so equal specs always
+// have the same key.
+func hashKey(spec interface{}) string {
+	b, _ := json.Marshal(spec)
+	hash := sha256.Sum256(b)
+	return hex.EncodeToString(hash[:])
+}
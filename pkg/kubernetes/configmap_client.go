@@ -20,12 +20,12 @@ import (
 	"fmt"
 
 	"k8s.io/client-go/kubernetes"
-	v1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-func CoreClient(kubeconfig string) (v1.CoreV1Interface, error) {
+// Client returns a client for the Kubernetes API server used to store Terraform state and locks.
+func Client(kubeconfig string) (kubernetes.Interface, error) {
 	var clientConfig *rest.Config
 	var err error
 	if len(kubeconfig) > 0 {
@@ -40,9 +40,5 @@ func CoreClient(kubeconfig string) (v1.CoreV1Interface, error) {
 		return nil, fmt.Errorf("failed to get configmap client kubeconfig: %v", err)
 	}
 
-	kc, err := kubernetes.NewForConfig(clientConfig)
-	if err != nil {
-		return nil, err
-	}
-	return kc.CoreV1(), nil
+	return kubernetes.NewForConfig(clientConfig)
 }
@@ -0,0 +1,59 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kubernetes
+
+import (
+	authenticationapi "k8s.io/api/authentication/v1"
+	authorizationapi "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/kubernetes"
+	authenticationv1 "k8s.io/client-go/kubernetes/typed/authentication/v1"
+	authorizationv1 "k8s.io/client-go/kubernetes/typed/authorization/v1"
+)
+
+// readinessCheckUser is the user and token used for readiness checks of the authentication and authorization clients.
+const readinessCheckUser = "tf-kubernetes-configmap-backend:readiness-check"
+
+// ClientCheck returns a check that the client can reach the API server.
+func ClientCheck(client kubernetes.Interface) func() error {
+	return func() error {
+		_, err := client.Discovery().ServerVersion()
+		return err
+	}
+}
+
+// AuthenticationClientCheck returns a check that the client can review tokens. The reviewed token is never valid.
+func AuthenticationClientCheck(client authenticationv1.TokenReviewInterface) func() error {
+	return func() error {
+		_, err := client.Create(&authenticationapi.TokenReview{
+			Spec: authenticationapi.TokenReviewSpec{Token: readinessCheckUser},
+		})
+		return err
+	}
+}
+
+// AuthorizationClientCheck returns a check that the client can review access. The reviewed user does not exist.
+func AuthorizationClientCheck(client authorizationv1.SubjectAccessReviewInterface) func() error {
+	return func() error {
+		_, err := client.Create(&authorizationapi.SubjectAccessReview{
+			Spec: authorizationapi.SubjectAccessReviewSpec{
+				User:                  readinessCheckUser,
+				NonResourceAttributes: &authorizationapi.NonResourceAttributes{Path: "/readyz", Verb: "get"},
+			},
+		})
+		return err
+	}
+}
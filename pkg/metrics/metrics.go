@@ -0,0 +1,241 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package metrics defines the Prometheus metrics exported by the backend.
+package metrics
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "tf_kubernetes_configmap_backend"
+
+var (
+	// Registry holds all metrics exported by the backend.
+	Registry = prometheus.NewRegistry()
+
+	// RequestsTotal counts handled requests by method and response status code.
+	RequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of handled HTTP requests by method and status code.",
+	}, []string{"method", "code"})
+	// RequestDuration observes the latency of handled requests by method and response status code.
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of handled HTTP requests by method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	// AuthenticationDuration observes the latency of TokenReview requests.
+	AuthenticationDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "authentication_duration_seconds",
+		Help:      "Latency of TokenReview requests made to authenticate requests.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	// AuthenticationErrorsTotal counts failed TokenReview requests.
+	AuthenticationErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "authentication_errors_total",
+		Help:      "Number of failed TokenReview requests made to authenticate requests.",
+	})
+	// AuthorizationDuration observes the latency of SubjectAccessReview requests.
+	AuthorizationDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "authorization_duration_seconds",
+		Help:      "Latency of SubjectAccessReview requests made to authorize requests.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	// AuthorizationErrorsTotal counts failed SubjectAccessReview requests.
+	AuthorizationErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "authorization_errors_total",
+		Help:      "Number of failed SubjectAccessReview requests made to authorize requests.",
+	})
+
+	// AuthenticationCacheRequestsTotal counts lookups of cached TokenReview responses by result, hit or miss.
+	AuthenticationCacheRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "authentication_cache_requests_total",
+		Help:      "Number of lookups of cached TokenReview responses by result (hit or miss).",
+	}, []string{"result"})
+	// AuthorizationCacheRequestsTotal counts lookups of cached SubjectAccessReview responses by result, hit or miss.
+	AuthorizationCacheRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "authorization_cache_requests_total",
+		Help:      "Number of lookups of cached SubjectAccessReview responses by result (hit or miss).",
+	}, []string{"result"})
+
+	// LockContentionTotal counts requests rejected because the state is locked by another lock holder.
+	LockContentionTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "lock_contention_total",
+		Help:      "Number of requests rejected with 423 Locked because the state is locked by another lock holder.",
+	})
+	// StateSizeBytes observes the size of written states as written by Terraform ("original") and as stored after
+	// minification, compression and encryption ("stored").
+	StateSizeBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "state_size_bytes",
+		Help:      "Size of written Terraform states, as written by Terraform (original) and as stored (stored).",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+	}, []string{"stage"})
+
+	// KubernetesAPIErrorsTotal counts failed requests to the Kubernetes API for objects storing state by resource,
+	// verb and reason, e.g. NotFound or Conflict.
+	KubernetesAPIErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kubernetes_api_errors_total",
+		Help:      "Number of failed Kubernetes API requests for objects storing state by resource, verb and reason.",
+	}, []string{"resource", "verb", "reason"})
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		RequestsTotal,
+		RequestDuration,
+		AuthenticationDuration,
+		AuthenticationErrorsTotal,
+		AuthorizationDuration,
+		AuthorizationErrorsTotal,
+		AuthenticationCacheRequestsTotal,
+		AuthorizationCacheRequestsTotal,
+		LockContentionTotal,
+		StateSizeBytes,
+		KubernetesAPIErrorsTotal,
+	)
+}
+
+// Handler returns a handler serving all metrics in Registry.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// methods are the request methods recorded in metrics. Requests with any other method are recorded as "other", so
+// that clients cannot create an unbounded number of time series.
+var methods = map[string]string{
+	http.MethodGet:     "get",
+	http.MethodHead:    "head",
+	http.MethodPost:    "post",
+	http.MethodPut:     "put",
+	http.MethodDelete:  "delete",
+	http.MethodOptions: "options",
+	"LOCK":             "lock",
+	"UNLOCK":           "unlock",
+}
+
+// InstrumentHandler records the count and latency of requests handled by next.
+func InstrumentHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, req)
+
+		method, ok := methods[req.Method]
+		if !ok {
+			method = "other"
+		}
+		code := strconv.Itoa(rec.status)
+		RequestsTotal.WithLabelValues(method, code).Inc()
+		RequestDuration.WithLabelValues(method, code).Observe(time.Since(start).Seconds())
+	})
+}
+
+// statusRecorder records the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
+
+// ObserveDuration observes the time elapsed since start.
+func ObserveDuration(observer prometheus.Observer, start time.Time) {
+	observer.Observe(time.Since(start).Seconds())
+}
+
+// Lock is a lock held on a Terraform state.
+type Lock struct {
+	Resource  string
+	Namespace string
+	Name      string
+	Workspace string
+	// Created is when the lock was acquired.
+	Created time.Time
+}
+
+// lockCollector exports the age of the locks held on Terraform states.
+type lockCollector struct {
+	desc *prometheus.Desc
+	list func() ([]Lock, error)
+}
+
+// NewLockCollector returns a collector exporting the age of the locks returned by list. Locks are listed from storage
+// on every collection, so that locks acquired or released through any replica are exported.
+func NewLockCollector(list func() ([]Lock, error)) prometheus.Collector {
+	return &lockCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "lock_age_seconds"),
+			"Age of the locks currently held on Terraform states.",
+			[]string{"resource", "namespace", "name", "workspace"}, nil,
+		),
+		list: list,
+	}
+}
+
+func (c *lockCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *lockCollector) Collect(ch chan<- prometheus.Metric) {
+	locks, err := c.list()
+	if err != nil {
+		log.Printf("failed to list locks: %v", err)
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+	now := time.Now()
+	for _, lock := range locks {
+		// Locks acquired by versions that did not record when locks were acquired have no known age.
+		if lock.Created.IsZero() {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, now.Sub(lock.Created).Seconds(),
+			lock.Resource, lock.Namespace, lock.Name, lock.Workspace)
+	}
+}
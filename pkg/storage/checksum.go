@@ -0,0 +1,200 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+)
+
+const (
+	// annotationKeyChecksum records the checksum of the state as returned on read, i.e. after any minification but
+	// before compression and encryption, in the form sha256:<hex digest>.
+	annotationKeyChecksum = annotationKeyPrefix + "checksum"
+	// annotationKeyContentLength records the size in bytes of the state as returned on read.
+	annotationKeyContentLength = annotationKeyPrefix + "content-length"
+)
+
+// contentDigest computes the checksum and length of the decoded state written to it.
+type contentDigest struct {
+	hash hash.Hash
+	n    int64
+}
+
+func newContentDigest() *contentDigest {
+	return &contentDigest{hash: sha256.New()}
+}
+
+func (d *contentDigest) Write(p []byte) (int, error) {
+	d.n += int64(len(p))
+	return d.hash.Write(p)
+}
+
+func (d *contentDigest) checksum() string {
+	return "sha256:" + hex.EncodeToString(d.hash.Sum(nil))
+}
+
+// contentLength returns the size in bytes of the state stored in object as returned on read, or -1 if it is not
+// known.
+func contentLength(object *stateObject) int64 {
+	n, err := strconv.ParseInt(object.Annotations[annotationKeyContentLength], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// etag returns the ETag of the state stored in object: its checksum, or its resourceVersion for state written before
+// checksums were recorded. It is empty if the object does not hold any state.
+func etag(object *stateObject) string {
+	if !hasTFState(object) {
+		return ""
+	}
+	if checksum, ok := object.Annotations[annotationKeyChecksum]; ok {
+		return checksum
+	}
+	return object.ResourceVersion
+}
+
+// checkIfMatch returns ErrPreconditionFailed if ifMatch is not nil and does not include the ETag of the state stored
+// in object.
+func checkIfMatch(object *stateObject, ifMatch []string) error {
+	if ifMatch == nil {
+		return nil
+	}
+	if current := etag(object); current != "" {
+		for _, e := range ifMatch {
+			if e == "*" || e == current {
+				return nil
+			}
+		}
+	}
+	return ErrPreconditionFailed
+}
+
+// verifyHoldBack is the number of bytes of decoded state that a verifyingReader holds back until the state has been
+// verified. States no larger than this are verified in full before any of the state is returned.
+const verifyHoldBack = 32 * 1024
+
+// verifyingReader verifies decoded state against the checksum and length recorded on its object as it is read, so
+// that state is read only once. The last bytes read are held back until the end of the state has been verified, so
+// that a reader streaming the state never receives corrupt state in full.
+type verifyingReader struct {
+	r        io.ReadCloser
+	checksum string
+	length   int64
+	digest   *contentDigest
+	buf      []byte
+	start    int
+	end      int
+	eof      bool
+	err      error
+}
+
+// verify returns a reader for the decoded state r stored in object that fails with an error wrapping ErrCorrupt at
+// the end of the state if it does not match the checksum recorded on the object. State written before checksums were
+// recorded is not verified.
+func verify(object *stateObject, r io.ReadCloser) io.ReadCloser {
+	checksum, ok := object.Annotations[annotationKeyChecksum]
+	if !ok {
+		return r
+	}
+	return &verifyingReader{
+		r:        r,
+		checksum: checksum,
+		length:   contentLength(object),
+		digest:   newContentDigest(),
+		buf:      make([]byte, 2*verifyHoldBack),
+	}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	// Read until more than verifyHoldBack bytes are buffered, or the end of the state has been read and verified.
+	for !v.eof && v.err == nil && v.end-v.start <= verifyHoldBack {
+		if v.end == len(v.buf) {
+			v.end = copy(v.buf, v.buf[v.start:v.end])
+			v.start = 0
+		}
+		n, err := v.r.Read(v.buf[v.end:])
+		_, _ = v.digest.Write(v.buf[v.end : v.end+n])
+		v.end += n
+		switch {
+		case err == io.EOF:
+			v.eof = true
+			v.err = v.verify()
+		case err != nil:
+			v.err = fmt.Errorf("failed to read state: %w", err)
+		}
+	}
+	if v.err != nil {
+		return 0, v.err
+	}
+
+	available := v.end - v.start
+	if !v.eof {
+		available -= verifyHoldBack
+	}
+	if available == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, v.buf[v.start:v.start+available])
+	v.start += n
+	return n, nil
+}
+
+func (v *verifyingReader) verify() error {
+	if v.length >= 0 && v.digest.n != v.length {
+		return fmt.Errorf("%w: length %d does not match recorded length %d", ErrCorrupt, v.digest.n, v.length)
+	}
+	if actual := v.digest.checksum(); actual != v.checksum {
+		return fmt.Errorf("%w: checksum %s does not match recorded checksum %s", ErrCorrupt, actual, v.checksum)
+	}
+	return nil
+}
+
+func (v *verifyingReader) Close() error {
+	return v.r.Close()
+}
+
+// openState returns a reader for the decoded state stored in object, verified as it is read.
+func (s *kubernetesStore) openState(client objectClient, object *stateObject, name string) (io.ReadCloser, error) {
+	stored, err := s.readTFState(object, client, name)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := s.decodeState(object, stored)
+	if err != nil {
+		return nil, err
+	}
+	return verify(object, decoded), nil
+}
+
+// setContentAnnotations records the checksum and length of the decoded stored state on the object, removing any
+// previous values if they are not known.
+func setContentAnnotations(object *stateObject, stored *storedState) {
+	if stored.checksum == "" {
+		delete(object.Annotations, annotationKeyChecksum)
+		delete(object.Annotations, annotationKeyContentLength)
+		return
+	}
+	object.Annotations[annotationKeyChecksum] = stored.checksum
+	object.Annotations[annotationKeyContentLength] = strconv.FormatInt(stored.contentLength, 10)
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// largeTestState returns a Terraform state of roughly size bytes.
+func largeTestState(size int) string {
+	return fmt.Sprintf(`{"version": 4, "serial": 1, "lineage": "test", "outputs": {"value": {"value": %q}}}`,
+		strings.Repeat("x", size))
+}
+
+func TestVerifyWhileReading(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		state string
+	}{
+		{name: "small", state: testState},
+		{name: "large", state: largeTestState(4 * verifyHoldBack)},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			store, err := NewKubernetesStore(client, ResourceConfigMaps, Options{Compression: CompressionNone, ChunkSize: 16 * 1024})
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := Key{Namespace: "default", Name: "state"}
+			if err := store.Put(key, strings.NewReader(c.state), PutOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			// The state, including every chunk, is read once.
+			client.ClearActions()
+			state, err := store.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := state.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			read, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(read) != c.state {
+				t.Errorf("expected state of %d bytes, got %d bytes", len(c.state), len(read))
+			}
+			gets := map[string]int{}
+			for _, action := range client.Actions() {
+				if get, ok := action.(k8stesting.GetAction); ok && action.GetVerb() == "get" {
+					gets[get.GetName()]++
+				}
+			}
+			for name, n := range gets {
+				if n != 1 {
+					t.Errorf("expected %s to be read once, got %d reads", name, n)
+				}
+			}
+
+			// Corrupt state fails before its end is returned.
+			configMap, err := client.CoreV1().ConfigMaps("default").Get("state", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			configMap.Annotations[annotationKeyChecksum] = "sha256:0000"
+			if _, err := client.CoreV1().ConfigMaps("default").Update(configMap); err != nil {
+				t.Fatal(err)
+			}
+			state, err = store.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r, err = state.Open(); err != nil {
+				t.Fatal(err)
+			}
+			read, err = ioutil.ReadAll(r)
+			if !errors.Is(err, ErrCorrupt) {
+				t.Errorf("expected corrupt state error, got %v", err)
+			}
+			if len(read) >= len(c.state) || !bytes.HasPrefix([]byte(c.state), read) {
+				t.Errorf("expected at most a prefix of the state to be read, got %d of %d bytes", len(read), len(c.state))
+			}
+			if len(c.state) <= verifyHoldBack && len(read) != 0 {
+				t.Errorf("expected no state to be read before verification, got %d bytes", len(read))
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+)
+
+const (
+	// DefaultChunkSize is the default maximum number of bytes of stored state kept in a single object. Base64
+	// encoding of binary data on the wire means this has to be comfortably smaller than the 1MB object size limit.
+	DefaultChunkSize = 768 * 1024
+
+	dataKeyTFState = "tfstate"
+
+	annotationKeyChunks = annotationKeyPrefix + "chunks"
+
+	labelKeyChunkOf         = annotationKeyPrefix + "chunk-of"
+	labelKeyChunkGeneration = annotationKeyPrefix + "chunk-generation"
+)
+
+// chunkManifest describes how stored state is split across chunk objects. It is stored as JSON in an annotation on
+// the primary object.
+type chunkManifest struct {
+	// Generation is the revision of the write that created the chunks, so that the chunks of a new write never
+	// overwrite the chunks of the currently readable state or of previous versions.
+	Generation int `json:"generation"`
+	// Count is the number of chunk objects.
+	Count int `json:"count"`
+	// Size is the total number of bytes across all chunks.
+	Size int `json:"size"`
+	// Nonce is unique to the write that created the chunks, so that concurrent writes of the same generation never
+	// write to the same chunk objects. It is empty for chunks written before nonces were introduced.
+	Nonce string `json:"nonce,omitempty"`
+}
+
+func chunkManifestFromObject(object *stateObject) (*chunkManifest, error) {
+	rawManifest, ok := object.Annotations[annotationKeyChunks]
+	if !ok {
+		return nil, nil
+	}
+	manifest := &chunkManifest{}
+	if err := json.Unmarshal([]byte(rawManifest), manifest); err != nil {
+		return nil, fmt.Errorf("invalid chunk manifest: %v", err)
+	}
+	return manifest, nil
+}
+
+func chunkObjectName(name string, manifest *chunkManifest, index int) string {
+	if manifest.Nonce == "" {
+		return fmt.Sprintf("%s-tfstate-%d-%d", name, manifest.Generation, index)
+	}
+	return fmt.Sprintf("%s-tfstate-%d-%s-%d", name, manifest.Generation, manifest.Nonce, index)
+}
+
+// hasTFState returns true if object holds state, either directly or via chunks.
+func hasTFState(object *stateObject) bool {
+	if _, ok := object.Data[dataKeyTFState]; ok {
+		return true
+	}
+	_, ok := object.Annotations[annotationKeyChunks]
+	return ok
+}
+
+// readTFState returns a reader for the stored (possibly compressed and encrypted) state, reading it from the chunk
+// objects of the named state if required. Chunks are fetched one at a time as the state is read.
+func (s *kubernetesStore) readTFState(object *stateObject, client objectClient, name string) (io.Reader, error) {
+	manifest, err := chunkManifestFromObject(object)
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return bytes.NewReader(object.Data[dataKeyTFState]), nil
+	}
+	return &chunkReader{client: client, name: name, manifest: manifest}, nil
+}
+
+// chunkReader reads stored state from chunk objects.
+type chunkReader struct {
+	client   objectClient
+	name     string
+	manifest *chunkManifest
+	index    int
+	chunk    []byte
+	read     int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.index == r.manifest.Count {
+			if r.read != r.manifest.Size {
+				return 0, fmt.Errorf("state chunks contain %d bytes, expected %d", r.read, r.manifest.Size)
+			}
+			return 0, io.EOF
+		}
+		chunkName := chunkObjectName(r.name, r.manifest, r.index)
+		chunk, err := r.client.Get(chunkName)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read state chunk %s: %v", chunkName, err)
+		}
+		r.chunk = chunk.Data[dataKeyTFState]
+		r.index++
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	r.read += n
+	return n, nil
+}
+
+// storedState is state written by a chunkWriter, held either inline or in chunk objects.
+type storedState struct {
+	// inline is the stored state if it fits in a single object.
+	inline []byte
+	// manifest describes the chunks holding the stored state if it does not fit in a single object.
+	manifest *chunkManifest
+	// checksum is the checksum of the decoded state, empty if not known.
+	checksum string
+	// contentLength is the size in bytes of the decoded state, only valid if the checksum is known.
+	contentLength int64
+}
+
+// size returns the number of bytes of stored state.
+func (st *storedState) size() int64 {
+	if st.manifest != nil {
+		return int64(st.manifest.Size)
+	}
+	return int64(len(st.inline))
+}
+
+// apply sets the stored state on object, which must be subsequently created or updated by the caller.
+func (st *storedState) apply(object *stateObject) error {
+	if object.Data == nil {
+		object.Data = make(map[string][]byte, 1)
+	}
+	if st.manifest == nil {
+		object.Data[dataKeyTFState] = st.inline
+		delete(object.Annotations, annotationKeyChunks)
+		return nil
+	}
+
+	rawManifest, err := json.Marshal(st.manifest)
+	if err != nil {
+		return err
+	}
+	if object.Annotations == nil {
+		object.Annotations = make(map[string]string, 1)
+	}
+	object.Annotations[annotationKeyChunks] = string(rawManifest)
+	delete(object.Data, dataKeyTFState)
+	return nil
+}
+
+// chunkWriter writes stored state as it is encoded. State that fits in a single object is held in memory to be
+// stored inline in the primary object. Larger state is written to a new generation of chunk objects as each chunk
+// fills, so at most one chunk is held in memory, and the primary object only references the chunks via the chunk
+// manifest. This means that the currently readable state is never modified until the primary object is written: on
+// failure the caller should call deleteChunkGeneration with the manifest to remove the unreferenced chunks.
+type chunkWriter struct {
+	s         *kubernetesStore
+	client    objectClient
+	namespace string
+	name      string
+	buf       []byte
+	manifest  *chunkManifest
+}
+
+// newChunkWriter returns a chunkWriter for the named state, writing chunks of the specified generation.
+func (s *kubernetesStore) newChunkWriter(client objectClient, namespace, name string, generation int) *chunkWriter {
+	return &chunkWriter{
+		s:         s,
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		buf:       make([]byte, 0, s.options.ChunkSize),
+		manifest:  &chunkManifest{Generation: generation, Nonce: utilrand.String(5)},
+	}
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only written once more data arrives, as state that exactly fills a single chunk is stored
+		// inline.
+		if len(w.buf) == w.s.options.ChunkSize {
+			if err := w.writeChunk(); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):w.s.options.ChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *chunkWriter) writeChunk() error {
+	chunk := &stateObject{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      chunkObjectName(w.name, w.manifest, w.manifest.Count),
+			Namespace: w.namespace,
+			Labels:    map[string]string{labelKeyChunkGeneration: strconv.Itoa(w.manifest.Generation)},
+		},
+		Data: map[string][]byte{dataKeyTFState: w.buf},
+	}
+	setNameLabel(&chunk.ObjectMeta, labelKeyChunkOf, w.name)
+	w.manifest.Count++
+	if _, err := w.client.Create(chunk); err != nil {
+		return fmt.Errorf("failed to write state chunk %s: %v", chunk.Name, err)
+	}
+	w.manifest.Size += len(w.buf)
+	w.buf = make([]byte, 0, w.s.options.ChunkSize)
+	return nil
+}
+
+// Close writes any remaining chunk and returns the stored state.
+func (w *chunkWriter) Close() (*storedState, error) {
+	if w.manifest.Count == 0 {
+		return &storedState{inline: w.buf}, nil
+	}
+	if len(w.buf) > 0 {
+		if err := w.writeChunk(); err != nil {
+			return nil, err
+		}
+	}
+	return &storedState{manifest: w.manifest}, nil
+}
+
+// abort deletes any chunks already written.
+func (w *chunkWriter) abort() {
+	w.s.deleteChunkGeneration(w.client, w.name, w.manifest)
+}
+
+// writeTFState writes the state read from r, encoding it with encode, to a chunkWriter for the named state. On failure
+// any chunks already written are deleted.
+func (s *kubernetesStore) writeTFState(client objectClient, namespace, name string, generation int, r io.Reader,
+	encode func(r io.Reader, w io.Writer) error) (*storedState, error) {
+	w := s.newChunkWriter(client, namespace, name, generation)
+	if err := encode(r, w); err != nil {
+		w.abort()
+		return nil, err
+	}
+	stored, err := w.Close()
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
+	return stored, nil
+}
+
+// deleteChunkGeneration removes the chunks of the specified manifest, leaving chunks of the same generation written
+// by concurrent writes untouched. Errors are only logged as unreferenced chunks are harmless and are cleaned up by
+// the next successful write.
+func (s *kubernetesStore) deleteChunkGeneration(client objectClient, name string, manifest *chunkManifest) {
+	if manifest == nil {
+		return
+	}
+	for i := 0; i < manifest.Count; i++ {
+		chunkName := chunkObjectName(name, manifest, i)
+		if err := client.Delete(chunkName, nil); err != nil && !apierrors.IsNotFound(err) {
+			log.Printf("failed to delete state chunk %s: %v", chunkName, err)
+		}
+	}
+}
+
+// deleteUnreferencedChunks removes the chunks of the named object of generations lower than below, apart from those of
+// the generations to keep. Chunks of higher generations may be being written by concurrent writes, so are never
+// removed.
+func (s *kubernetesStore) deleteUnreferencedChunks(client objectClient, name string, below int, keepGenerations []int) {
+	lower, err := labels.NewRequirement(labelKeyChunkGeneration, selection.LessThan, []string{strconv.Itoa(below)})
+	if err != nil {
+		log.Printf("failed to build chunk selector for %s: %v", name, err)
+		return
+	}
+	selector := nameSelector(labelKeyChunkOf, name).Add(*lower)
+	if len(keepGenerations) > 0 {
+		values := make([]string, 0, len(keepGenerations))
+		for _, generation := range keepGenerations {
+			values = append(values, strconv.Itoa(generation))
+		}
+		requirement, err := labels.NewRequirement(labelKeyChunkGeneration, selection.NotIn, values)
+		if err != nil {
+			log.Printf("failed to build chunk selector for %s: %v", name, err)
+			return
+		}
+		selector = selector.Add(*requirement)
+	}
+	if err := client.DeleteCollection(metav1.ListOptions{LabelSelector: selector.String()}); err != nil {
+		log.Printf("failed to delete unreferenced state chunks of %s: %v", name, err)
+	}
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/encryption"
+)
+
+const (
+	// CompressionNone stores state uncompressed.
+	CompressionNone = "none"
+	// CompressionGzip compresses stored state with gzip.
+	CompressionGzip = "gzip"
+	// CompressionZstd compresses stored state with zstd, which is considerably faster than gzip for large states.
+	CompressionZstd = "zstd"
+
+	// minZstdLevel and maxZstdLevel bound the zstd compression levels, which are mapped to the nearest level supported
+	// by the zstd implementation.
+	minZstdLevel = 1
+	maxZstdLevel = 22
+
+	annotationKeyCompression = annotationKeyPrefix + "compression"
+	annotationKeyMinified    = annotationKeyPrefix + "minified"
+	annotationKeyEncrypted   = annotationKeyPrefix + "encrypted"
+)
+
+// Compressions lists all supported compression algorithms.
+var Compressions = []string{CompressionNone, CompressionGzip, CompressionZstd}
+
+var (
+	// gzipMagic prefixes all gzip compressed data.
+	gzipMagic = []byte{0x1f, 0x8b}
+	// zstdMagic prefixes all zstd compressed data.
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// setEncodingAnnotations records how state written with the current options is encoded on the object.
+func (s *kubernetesStore) setEncodingAnnotations(object *stateObject) {
+	if object.Annotations == nil {
+		object.Annotations = make(map[string]string, 3)
+	}
+	object.Annotations[annotationKeyCompression] = s.options.Compression
+	object.Annotations[annotationKeyMinified] = strconv.FormatBool(s.options.Minify)
+	object.Annotations[annotationKeyEncrypted] = strconv.FormatBool(s.options.KeyProvider != nil)
+}
+
+// encodeState writes the state read from r to w as it should be stored, minifying, compressing and encrypting as
+// configured. The state is processed as a stream, so is never held in memory in its entirety. If decoded is not nil,
+// the state is also written to it as it is returned on read, i.e. after minification.
+func (s *kubernetesStore) encodeState(r io.Reader, w io.Writer, decoded io.Writer) error {
+	// Writers are closed in reverse order of creation, flushing each into the next.
+	var closers []io.Closer
+	if s.options.KeyProvider != nil {
+		encw, err := encryption.NewWriter(w, s.options.KeyProvider)
+		if err != nil {
+			return err
+		}
+		w = encw
+		closers = append(closers, encw)
+	}
+	switch s.options.Compression {
+	case CompressionGzip:
+		level := s.options.CompressionLevel
+		if level == 0 {
+			level = gzip.BestCompression
+		}
+		gzw, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return err
+		}
+		w = gzw
+		closers = append(closers, gzw)
+	case CompressionZstd:
+		encoderOptions := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if s.options.CompressionLevel != 0 {
+			encoderOptions = append(encoderOptions,
+				zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(s.options.CompressionLevel)))
+		}
+		zw, err := zstd.NewWriter(w, encoderOptions...)
+		if err != nil {
+			return err
+		}
+		w = zw
+		closers = append(closers, zw)
+	}
+	if decoded != nil {
+		w = io.MultiWriter(w, decoded)
+	}
+	if s.options.Minify {
+		w = newJSONMinifier(w)
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err := closers[i].Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeState returns a reader for the original state from the state stored in object and read from r. The encoding
+// recorded on the object is used to decode the state rather than the current options, so that options can be changed
+// without making existing state unreadable. State written before encodings were recorded is detected from its
+// content.
+func (s *kubernetesStore) decodeState(object *stateObject, r io.Reader) (io.ReadCloser, error) {
+	r, err := s.decryptState(r)
+	if err != nil {
+		return nil, err
+	}
+
+	compression, recorded := object.Annotations[annotationKeyCompression]
+	if !recorded {
+		br := bufio.NewReader(r)
+		magic, _ := br.Peek(len(zstdMagic))
+		switch {
+		case bytes.HasPrefix(magic, gzipMagic):
+			compression = CompressionGzip
+		case bytes.HasPrefix(magic, zstdMagic):
+			compression = CompressionZstd
+		}
+		r = br
+	}
+
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case CompressionNone, "":
+		return ioutil.NopCloser(r), nil
+	default:
+		return nil, fmt.Errorf("unsupported state compression %q", compression)
+	}
+}
+
+// decryptState returns a reader for the stored state read from r with any encryption removed. Unencrypted state is
+// returned as is, so that state written before encryption was enabled can still be read.
+func (s *kubernetesStore) decryptState(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if prefix, _ := br.Peek(encryption.MagicSize); !encryption.IsEncrypted(prefix) {
+		return br, nil
+	}
+	return encryption.NewReader(br, s.options.KeyProvider)
+}
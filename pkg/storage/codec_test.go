@@ -0,0 +1,205 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// benchmarkState returns Terraform state JSON of roughly the requested size, shaped like the state of a typical cloud
+// infrastructure workspace: many resources with nested attributes, IDs, ARNs, tags and embedded JSON documents.
+func benchmarkState(size int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	hex := func(n int) string {
+		b := make([]byte, n/2)
+		rng.Read(b)
+		return fmt.Sprintf("%x", b)
+	}
+
+	type instance struct {
+		SchemaVersion int                    `json:"schema_version"`
+		Attributes    map[string]interface{} `json:"attributes"`
+		Private       string                 `json:"private"`
+		Dependencies  []string               `json:"dependencies,omitempty"`
+	}
+	type resource struct {
+		Mode      string     `json:"mode"`
+		Type      string     `json:"type"`
+		Name      string     `json:"name"`
+		Provider  string     `json:"provider"`
+		Instances []instance `json:"instances"`
+	}
+	state := struct {
+		Version          int                    `json:"version"`
+		TerraformVersion string                 `json:"terraform_version"`
+		Serial           int                    `json:"serial"`
+		Lineage          string                 `json:"lineage"`
+		Outputs          map[string]interface{} `json:"outputs"`
+		Resources        []resource             `json:"resources"`
+	}{
+		Version:          4,
+		TerraformVersion: "0.12.24",
+		Serial:           42,
+		Lineage:          "3f8d2b6a-5c1e-4b7f-9a0d-2e6c8b4f1a3d",
+		Outputs:          map[string]interface{}{},
+	}
+
+	resourceTypes := []string{"aws_instance", "aws_security_group", "aws_iam_role", "aws_s3_bucket", "aws_route53_record"}
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < size; i++ {
+		resourceType := resourceTypes[i%len(resourceTypes)]
+		id := hex(16)
+		state.Resources = append(state.Resources, resource{
+			Mode:     "managed",
+			Type:     resourceType,
+			Name:     fmt.Sprintf("resource_%d", i),
+			Provider: `provider["registry.terraform.io/hashicorp/aws"]`,
+			Instances: []instance{{
+				SchemaVersion: 1,
+				Attributes: map[string]interface{}{
+					"id":                id,
+					"arn":               fmt.Sprintf("arn:aws:%s:eu-west-1:123456789012:%s/%s", resourceType, resourceType, id),
+					"availability_zone": "eu-west-1a",
+					"private_ip":        fmt.Sprintf("10.%d.%d.%d", rng.Intn(256), rng.Intn(256), rng.Intn(256)),
+					"subnet_id":         "subnet-" + hex(16),
+					"tags": map[string]string{
+						"Name":        fmt.Sprintf("resource-%d", i),
+						"Environment": "production",
+						"Team":        "platform",
+					},
+					"policy": `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":["s3:GetObject"],"Resource":"*"}]}`,
+					"ingress": []map[string]interface{}{
+						{"from_port": 443, "to_port": 443, "protocol": "tcp", "cidr_blocks": []string{"0.0.0.0/0"}},
+						{"from_port": 22, "to_port": 22, "protocol": "tcp", "cidr_blocks": []string{"10.0.0.0/8"}},
+					},
+				},
+				Private: hex(64),
+			}},
+		})
+		// Encoding all resources on every iteration would be quadratic, so only estimate the size periodically.
+		if i%100 == 0 {
+			buf.Reset()
+			_ = json.NewEncoder(&buf).Encode(state)
+		}
+	}
+
+	data, _ := json.MarshalIndent(state, "", "  ")
+	return data
+}
+
+var benchmarkCodecs = []struct {
+	name    string
+	options Options
+}{
+	{"none", Options{Compression: CompressionNone}},
+	{"gzip-1", Options{Compression: CompressionGzip, CompressionLevel: 1}},
+	{"gzip-6", Options{Compression: CompressionGzip, CompressionLevel: 6}},
+	{"gzip-9", Options{Compression: CompressionGzip, CompressionLevel: 9}},
+	{"zstd-1", Options{Compression: CompressionZstd, CompressionLevel: 1}},
+	{"zstd-3", Options{Compression: CompressionZstd, CompressionLevel: 3}},
+	{"zstd-11", Options{Compression: CompressionZstd, CompressionLevel: 11}},
+	{"gzip-9-minified", Options{Compression: CompressionGzip, CompressionLevel: 9, Minify: true}},
+	{"zstd-3-minified", Options{Compression: CompressionZstd, CompressionLevel: 3, Minify: true}},
+}
+
+var benchmarkStateSizes = []int{1 << 20, 16 << 20}
+
+// BenchmarkEncodeState measures the latency of encoding realistic state, reporting the stored size as a percentage
+// of the original size.
+func BenchmarkEncodeState(b *testing.B) {
+	for _, size := range benchmarkStateSizes {
+		state := benchmarkState(size)
+		for _, codec := range benchmarkCodecs {
+			b.Run(fmt.Sprintf("%dMB/%s", size>>20, codec.name), func(b *testing.B) {
+				s := &kubernetesStore{options: codec.options}
+				b.SetBytes(int64(len(state)))
+				var encoded bytes.Buffer
+				for i := 0; i < b.N; i++ {
+					encoded.Reset()
+					if err := s.encodeState(bytes.NewReader(state), &encoded, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(100*float64(encoded.Len())/float64(len(state)), "%size")
+			})
+		}
+	}
+}
+
+// BenchmarkDecodeState measures the latency of decoding realistic state.
+func BenchmarkDecodeState(b *testing.B) {
+	for _, size := range benchmarkStateSizes {
+		state := benchmarkState(size)
+		for _, codec := range benchmarkCodecs {
+			b.Run(fmt.Sprintf("%dMB/%s", size>>20, codec.name), func(b *testing.B) {
+				s := &kubernetesStore{options: codec.options}
+				var encoded bytes.Buffer
+				if err := s.encodeState(bytes.NewReader(state), &encoded, nil); err != nil {
+					b.Fatal(err)
+				}
+				object := &stateObject{}
+				s.setEncodingAnnotations(object)
+				b.SetBytes(int64(len(state)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					r, err := s.decodeState(object, bytes.NewReader(encoded.Bytes()))
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := io.Copy(ioutil.Discard, r); err != nil {
+						b.Fatal(err)
+					}
+					r.Close()
+				}
+			})
+		}
+	}
+}
+
+func TestCompressionLevels(t *testing.T) {
+	for _, c := range []struct {
+		compression string
+		level       int
+		valid       bool
+	}{
+		{compression: CompressionGzip, level: -3},
+		{compression: CompressionGzip, level: -2, valid: true},
+		{compression: CompressionGzip, level: -1, valid: true},
+		{compression: CompressionGzip, level: 0, valid: true},
+		{compression: CompressionGzip, level: 9, valid: true},
+		{compression: CompressionGzip, level: 10},
+		{compression: CompressionZstd, level: -1},
+		{compression: CompressionZstd, level: 0, valid: true},
+		{compression: CompressionZstd, level: 1, valid: true},
+		{compression: CompressionZstd, level: 22, valid: true},
+		{compression: CompressionZstd, level: 23},
+	} {
+		options := Options{Compression: c.compression, CompressionLevel: c.level}
+		_, err := NewKubernetesStore(fake.NewSimpleClientset(), ResourceConfigMaps, options)
+		if valid := err == nil; valid != c.valid {
+			t.Errorf("expected %s level %d to be valid %t, got error %v", c.compression, c.level, c.valid, err)
+		}
+	}
+}
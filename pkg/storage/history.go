@@ -0,0 +1,262 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/tfstate"
+)
+
+const (
+	annotationKeyRevision = annotationKeyPrefix + "revision"
+	annotationKeySerial   = annotationKeyPrefix + "serial"
+	annotationKeyLineage  = annotationKeyPrefix + "lineage"
+
+	annotationKeyTerraformVersion = annotationKeyPrefix + "terraform-version"
+	annotationKeySize             = annotationKeyPrefix + "size"
+	annotationKeyLastModified     = annotationKeyPrefix + "last-modified"
+
+	labelKeyHistoryOf       = annotationKeyPrefix + "history-of"
+	labelKeyHistoryRevision = annotationKeyPrefix + "history-revision"
+	labelKeyHistorySerial   = annotationKeyPrefix + "history-serial"
+)
+
+func historyObjectName(name string, revision int) string {
+	return fmt.Sprintf("%s-history-%d", name, revision)
+}
+
+// currentRevision returns the revision of the last write to the object. Objects written before revisions were
+// recorded fall back to the chunk generation, which was incremented in the same way.
+func currentRevision(object *stateObject) int {
+	revision, _ := strconv.Atoi(object.Annotations[annotationKeyRevision])
+	if manifest, err := chunkManifestFromObject(object); err == nil && manifest != nil && manifest.Generation > revision {
+		revision = manifest.Generation
+	}
+	return revision
+}
+
+// latestRevision returns the revision of the last write to the named state stored in object. A deleted state that is
+// written again continues from the revisions of its remaining history, so that neither history objects nor chunks of
+// the deleted state are overwritten.
+func (s *kubernetesStore) latestRevision(client objectClient, object *stateObject, exists bool,
+	name string) (int, error) {
+	if exists {
+		return currentRevision(object), nil
+	}
+	history, err := s.listHistory(client, name)
+	if err != nil {
+		return 0, err
+	}
+	if len(history) == 0 {
+		return 0, nil
+	}
+	return currentRevision(history[0]), nil
+}
+
+// setStateAnnotations records the revision, size and modification time, and the header of the written state on the
+// object. The recorded header is kept if the written state has no readable header, so that a forced write of state
+// that is not Terraform state does not disable the checks of later writes.
+func setStateAnnotations(object *stateObject, revision int, size int64, header *tfstate.Header) {
+	if object.Annotations == nil {
+		object.Annotations = make(map[string]string, 6)
+	}
+	object.Annotations[annotationKeyRevision] = strconv.Itoa(revision)
+	object.Annotations[annotationKeySize] = strconv.FormatInt(size, 10)
+	object.Annotations[annotationKeyLastModified] = time.Now().UTC().Format(time.RFC3339)
+	if header == nil {
+		return
+	}
+	object.Annotations[annotationKeySerial] = strconv.FormatUint(header.Serial, 10)
+	object.Annotations[annotationKeyLineage] = header.Lineage
+	object.Annotations[annotationKeyTerraformVersion] = header.TerraformVersion
+}
+
+// checkStateHeader returns a *ConflictError if the header of the written state has a different lineage or a lower
+// serial than the state stored in object, or cannot be read although the stored state has a recorded header. States
+// without a recorded header, e.g. written before headers were recorded, are not checked.
+func checkStateHeader(object *stateObject, header *tfstate.Header) error {
+	storedSerial, hasSerial := object.Annotations[annotationKeySerial]
+	if !hasSerial {
+		return nil
+	}
+	serial, err := strconv.ParseUint(storedSerial, 10, 64)
+	if err != nil {
+		return nil
+	}
+	stored := tfstate.Header{Serial: serial, Lineage: object.Annotations[annotationKeyLineage]}
+
+	switch {
+	case header == nil:
+		return &ConflictError{
+			Reason: fmt.Sprintf("state has no readable lineage and serial, but stored state has lineage %q and serial %d",
+				stored.Lineage, stored.Serial),
+			Stored: stored,
+		}
+	case stored.Lineage != "" && header.Lineage != stored.Lineage:
+		return &ConflictError{
+			Reason:    fmt.Sprintf("state lineage %q does not match stored state lineage %q", header.Lineage, stored.Lineage),
+			Stored:    stored,
+			Requested: *header,
+		}
+	case header.Serial < stored.Serial:
+		return &ConflictError{
+			Reason:    fmt.Sprintf("state serial %d is older than stored state serial %d", header.Serial, stored.Serial),
+			Stored:    stored,
+			Requested: *header,
+		}
+	}
+	return nil
+}
+
+// saveHistory stores the state currently held by object as an immutable history object. History objects share the
+// chunks of the state they were copied from, so that no state data is copied.
+func (s *kubernetesStore) saveHistory(client objectClient, object *stateObject, name string) error {
+	if s.options.HistoryLimit <= 0 || !hasTFState(object) {
+		return nil
+	}
+
+	revision := currentRevision(object)
+	history := &stateObject{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      historyObjectName(name, revision),
+			Namespace: object.Namespace,
+			Labels:    map[string]string{labelKeyHistoryRevision: strconv.Itoa(revision)},
+			Annotations: map[string]string{
+				annotationKeyRevision: strconv.Itoa(revision),
+			},
+		},
+		Data: make(map[string][]byte, 1),
+	}
+	setNameLabel(&history.ObjectMeta, labelKeyHistoryOf, name)
+	for _, k := range []string{
+		annotationKeyChunks, annotationKeySerial, annotationKeyLineage, annotationKeyTerraformVersion,
+		annotationKeySize, annotationKeyLastModified, annotationKeyCompression, annotationKeyMinified, annotationKeyEncrypted,
+		annotationKeyChecksum, annotationKeyContentLength,
+	} {
+		if v, ok := object.Annotations[k]; ok {
+			history.Annotations[k] = v
+		}
+	}
+	if serial, ok := object.Annotations[annotationKeySerial]; ok {
+		history.Labels[labelKeyHistorySerial] = serial
+	}
+	if state, ok := object.Data[dataKeyTFState]; ok {
+		history.Data[dataKeyTFState] = state
+	}
+
+	// A history object for the same revision can only be left over from a previously failed write of the same state,
+	// so it already holds the same content.
+	if _, err := client.Create(history); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to save state history %s: %v", history.Name, err)
+	}
+	return nil
+}
+
+// listHistory returns the history objects of the named state, most recent first.
+func (s *kubernetesStore) listHistory(client objectClient, name string) ([]*stateObject, error) {
+	selector := nameSelector(labelKeyHistoryOf, name)
+	history, err := client.List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(history, func(i, j int) bool {
+		return currentRevision(history[i]) > currentRevision(history[j])
+	})
+	return history, nil
+}
+
+// pruneHistory deletes history objects beyond the configured limit or older than the configured maximum age. It
+// returns the chunk generations still referenced by the remaining history objects.
+func (s *kubernetesStore) pruneHistory(client objectClient, name string) ([]int, error) {
+	history, err := s.listHistory(client, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var referencedGenerations []int
+	for i, object := range history {
+		expired := s.options.HistoryMaxAge > 0 && time.Since(object.CreationTimestamp.Time) > s.options.HistoryMaxAge
+		if i < s.options.HistoryLimit && !expired {
+			if manifest, err := chunkManifestFromObject(object); err == nil && manifest != nil {
+				referencedGenerations = append(referencedGenerations, manifest.Generation)
+			}
+			continue
+		}
+		if err := client.Delete(object.Name, nil); err != nil && !apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("failed to delete state history %s: %v", object.Name, err)
+		}
+	}
+	return referencedGenerations, nil
+}
+
+func (s *kubernetesStore) ListVersions(key Key) ([]Version, error) {
+	client := s.clientFor(key.Namespace)
+	_, exists, err := s.get(client, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// The history of a deleted state is kept, so can be listed without the state.
+	history, err := s.listHistory(client, objectName(key))
+	if err != nil {
+		return nil, err
+	}
+	if !exists && len(history) == 0 {
+		return nil, ErrNotFound
+	}
+	versions := make([]Version, 0, len(history))
+	for _, object := range history {
+		serial, _ := strconv.ParseUint(object.Annotations[annotationKeySerial], 10, 64)
+		versions = append(versions, Version{
+			Revision: currentRevision(object),
+			Serial:   serial,
+			Lineage:  object.Annotations[annotationKeyLineage],
+			Created:  object.CreationTimestamp.Time,
+		})
+	}
+	return versions, nil
+}
+
+func (s *kubernetesStore) GetVersion(key Key, revision int) (*State, error) {
+	client := s.clientFor(key.Namespace)
+	object, err := client.Get(historyObjectName(objectName(key), revision))
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if historyOf, _ := nameLabel(object.ObjectMeta, labelKeyHistoryOf); historyOf != objectName(key) {
+		return nil, ErrNotFound
+	}
+
+	return &State{
+		ETag:          etag(object),
+		ContentLength: contentLength(object),
+		Open: func() (io.ReadCloser, error) {
+			return s.openState(client, object, objectName(key))
+		},
+	}, nil
+}
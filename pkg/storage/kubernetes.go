@@ -0,0 +1,483 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	coordinationv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/encryption"
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/metrics"
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/tfstate"
+)
+
+// Options configures how Terraform state is stored in Kubernetes objects.
+type Options struct {
+	// Compression is the algorithm used to compress stored state, one of Compressions. Defaults to CompressionNone.
+	Compression string
+	// CompressionLevel is the compression level, specific to the algorithm: gzip.HuffmanOnly, gzip.DefaultCompression or
+	// 1-9 for gzip, and 1-22 for zstd. Zero uses gzip.BestCompression for gzip, and zstd's default level for zstd.
+	CompressionLevel int
+	// Minify enables minification of stored state.
+	Minify bool
+	// ChunkSize is the maximum number of bytes of stored state kept in a single object before it is split across
+	// multiple objects. Defaults to DefaultChunkSize.
+	ChunkSize int
+	// HistoryLimit is the number of previous versions of each state to keep. Zero disables state history.
+	HistoryLimit int
+	// HistoryMaxAge is the maximum age of previous versions to keep. Zero keeps previous versions regardless of age.
+	HistoryMaxAge time.Duration
+	// KeyProvider enables envelope encryption of stored state with data keys encrypted by the provider. State
+	// encrypted with a previous key is re-encrypted with the current key when it is read.
+	KeyProvider encryption.KeyProvider
+	// SkipStateChecks allows writes of state with a different lineage or a lower serial than the stored state.
+	SkipStateChecks bool
+	// LockMode is how locks are stored, one of LockModes. Defaults to LockModeAnnotations.
+	LockMode string
+	// LockTTL is the duration after which a lock expires if it is not renewed by the lock holder when LockMode is
+	// LockModeLease. Defaults to DefaultLockTTL.
+	LockTTL time.Duration
+	// ProjectOutputs enables writing the outputs of every written state to a configmap, and its sensitive outputs to
+	// a secret, that can be consumed by workloads. See AnnotationKeyOutputsConfigMap and AnnotationKeyOutputsSecret.
+	ProjectOutputs bool
+}
+
+type kubernetesStore struct {
+	resource  string
+	clientFor objectClientFactory
+	core      corev1.CoreV1Interface
+	leases    coordinationv1.LeasesGetter
+	options   Options
+}
+
+var _ StateStore = &kubernetesStore{}
+
+// NewKubernetesStore returns a StateStore that stores state in Kubernetes objects of the specified resource, one of
+// Resources.
+func NewKubernetesStore(client kubernetes.Interface, resource string, options Options) (StateStore, error) {
+	clientFor, err := newObjectClientFactory(client.CoreV1(), resource)
+	if err != nil {
+		return nil, err
+	}
+	if options.ChunkSize <= 0 {
+		options.ChunkSize = DefaultChunkSize
+	}
+	switch options.Compression {
+	case "":
+		options.Compression = CompressionNone
+	case CompressionNone, CompressionGzip, CompressionZstd:
+	default:
+		return nil, fmt.Errorf("invalid compression %q", options.Compression)
+	}
+	if options.Compression == CompressionGzip && options.CompressionLevel != 0 &&
+		(options.CompressionLevel < gzip.HuffmanOnly || options.CompressionLevel > gzip.BestCompression) {
+		return nil, fmt.Errorf("invalid gzip compression level %d", options.CompressionLevel)
+	}
+	if options.Compression == CompressionZstd && options.CompressionLevel != 0 &&
+		(options.CompressionLevel < minZstdLevel || options.CompressionLevel > maxZstdLevel) {
+		return nil, fmt.Errorf("invalid zstd compression level %d", options.CompressionLevel)
+	}
+	switch options.LockMode {
+	case "":
+		options.LockMode = LockModeAnnotations
+	case LockModeAnnotations, LockModeLease:
+	default:
+		return nil, fmt.Errorf("invalid lock mode %q", options.LockMode)
+	}
+	if options.LockTTL <= 0 {
+		options.LockTTL = DefaultLockTTL
+	}
+	return &kubernetesStore{
+		resource:  resource,
+		clientFor: clientFor,
+		core:      client.CoreV1(),
+		leases:    client.CoordinationV1(),
+		options:   options,
+	}, nil
+}
+
+func (s *kubernetesStore) Resource() string {
+	return s.resource
+}
+
+// get returns the object storing the state, or a new object and false if it does not exist yet.
+func (s *kubernetesStore) get(client objectClient, key Key) (*stateObject, bool, error) {
+	object, err := client.Get(objectName(key))
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			object = &stateObject{ObjectMeta: metav1.ObjectMeta{Name: objectName(key), Namespace: key.Namespace}}
+			setWorkspaceLabels(&object.ObjectMeta, key)
+			return object, false, nil
+		}
+		return nil, false, err
+	}
+	if err := checkStateObject(object); err != nil {
+		return nil, false, err
+	}
+	if err := checkWorkspace(object, key); err != nil {
+		return nil, false, err
+	}
+	return object, true, nil
+}
+
+// checkStateObject returns an error wrapping ErrInvalidKey if object is not an object storing state, but e.g. a history
+// or chunk object of a state. Their names can equal the name of another state, which must not be able to read or
+// overwrite them.
+func checkStateObject(object *stateObject) error {
+	for _, labelKey := range []string{labelKeyHistoryOf, labelKeyChunkOf, labelKeyOutputsOf} {
+		if name, ok := object.Labels[labelKey]; ok {
+			return fmt.Errorf("%w: %s does not store state, it is labelled %s=%s", ErrInvalidKey, object.Name,
+				labelKey, name)
+		}
+	}
+	return nil
+}
+
+// retryOnConflict calls fn until it does not fail because an object was modified or created concurrently. Updates are
+// made with the resourceVersion of the object as read, so every attempt re-reads the objects it modifies and
+// re-evaluates the request against their current state, e.g. a concurrent LOCK request that loses the race to create
+// the lock sees the winner's lock on the next attempt.
+func retryOnConflict(fn func() error) error {
+	return retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}, fn)
+}
+
+// save creates or updates the object depending on whether it exists.
+func (s *kubernetesStore) save(client objectClient, object *stateObject, exists bool) error {
+	var err error
+	if exists {
+		_, err = client.Update(object)
+	} else {
+		_, err = client.Create(object)
+	}
+	return err
+}
+
+func (s *kubernetesStore) Get(key Key) (*State, error) {
+	client := s.clientFor(key.Namespace)
+	object, exists, err := s.get(client, key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	state := &State{}
+	if s.options.LockMode == LockModeLease {
+		if _, state.Lock, err = s.currentLeaseLock(key); err != nil {
+			return nil, err
+		}
+	} else {
+		state.Lock = lockInfoFromObject(object)
+	}
+	if hasTFState(object) {
+		state.ETag, state.ContentLength = etag(object), contentLength(object)
+		state.Open = func() (io.ReadCloser, error) {
+			stored, err := s.readTFState(object, client, objectName(key))
+			if err != nil {
+				return nil, err
+			}
+			br := bufio.NewReaderSize(stored, headerPeekSize)
+			if s.needsReencryption(br) {
+				if err := s.reencrypt(client, object); err != nil {
+					log.Printf("failed to re-encrypt state %s: %v", key, err)
+				}
+			}
+			decoded, err := s.decodeState(object, br)
+			if err != nil {
+				return nil, err
+			}
+			return verify(object, decoded), nil
+		}
+	}
+	return state, nil
+}
+
+// headerPeekSize is the number of bytes at the start of written state that are buffered to read the state header.
+const headerPeekSize = 64 * 1024
+
+func (s *kubernetesStore) Put(key Key, state io.Reader, options PutOptions) error {
+	if err := key.Validate(); err != nil {
+		return err
+	}
+	body := bufio.NewReaderSize(state, headerPeekSize)
+	prefix, err := body.Peek(headerPeekSize)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read state: %w", err)
+	}
+	header, err := tfstate.ReadHeader(bytes.NewReader(prefix))
+	if err != nil {
+		log.Printf("failed to read header of state %s: %v", key, err)
+	}
+
+	// The request is checked before the state is written, so that requests that would be rejected do not need to
+	// write the state.
+	client := s.clientFor(key.Namespace)
+	object, exists, err := s.get(client, key)
+	if err != nil {
+		return err
+	}
+	if err := s.checkPut(key, object, header, options); err != nil {
+		return err
+	}
+	latest, err := s.latestRevision(client, object, exists, objectName(key))
+	if err != nil {
+		return err
+	}
+
+	counter := &countingReader{r: body}
+	contentMD5 := md5.New()
+	digest := newContentDigest()
+	stored, err := s.writeTFState(client, key.Namespace, objectName(key), latest+1,
+		io.TeeReader(counter, contentMD5), func(r io.Reader, w io.Writer) error {
+			return s.encodeState(r, w, digest)
+		})
+	if err != nil {
+		return fmt.Errorf("failed to write state: %w", err)
+	}
+	if options.ContentMD5 != nil && !bytes.Equal(contentMD5.Sum(nil), options.ContentMD5) {
+		s.deleteChunkGeneration(client, objectName(key), stored.manifest)
+		return fmt.Errorf("%w: MD5 digest %s of state does not match Content-MD5 %s", ErrChecksumMismatch,
+			base64.StdEncoding.EncodeToString(contentMD5.Sum(nil)), base64.StdEncoding.EncodeToString(options.ContentMD5))
+	}
+	stored.checksum, stored.contentLength = digest.checksum(), digest.n
+
+	err = retryOnConflict(func() error {
+		return s.put(client, key, stored, counter.n, header, options)
+	})
+	if err != nil {
+		s.deleteChunkGeneration(client, objectName(key), stored.manifest)
+		return err
+	}
+	metrics.StateSizeBytes.WithLabelValues("original").Observe(float64(counter.n))
+	metrics.StateSizeBytes.WithLabelValues("stored").Observe(float64(stored.size()))
+
+	if s.options.ProjectOutputs {
+		s.projectOutputs(client, key)
+	}
+	return nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// checkPut checks that the lock ID, the preconditions and the state header of a write are valid for the current state
+// in object.
+func (s *kubernetesStore) checkPut(key Key, object *stateObject, header *tfstate.Header, options PutOptions) error {
+	// If the object is locked, then check the request comes from the locker.
+	if err := s.checkLockID(key, object, options.LockID); err != nil {
+		return err
+	}
+	if err := checkIfMatch(object, options.IfMatch); err != nil {
+		return err
+	}
+	if !options.Force && !s.options.SkipStateChecks {
+		return checkStateHeader(object, header)
+	}
+	return nil
+}
+
+// put updates the object to reference the stored state, failing with a conflict if the state is modified
+// concurrently.
+func (s *kubernetesStore) put(client objectClient, key Key, stored *storedState, size int64, header *tfstate.Header,
+	options PutOptions) error {
+	object, exists, err := s.get(client, key)
+	if err != nil {
+		return err
+	}
+	if err := s.checkPut(key, object, header, options); err != nil {
+		return err
+	}
+	latest, err := s.latestRevision(client, object, exists, objectName(key))
+	if err != nil {
+		return err
+	}
+
+	// Chunks are only removed by writes of a higher revision than their generation, so if such a write has completed
+	// since the chunks were written they may have been removed.
+	if stored.manifest != nil && latest > stored.manifest.Generation {
+		return &ConflictError{Reason: "state was modified by a concurrent write while it was being written"}
+	}
+
+	// The current state is saved to history before it is overwritten so that it can never be lost.
+	if err := s.saveHistory(client, object, objectName(key)); err != nil {
+		return err
+	}
+
+	revision := latest + 1
+	if err := stored.apply(object); err != nil {
+		return err
+	}
+	setStateAnnotations(object, revision, size, header)
+	setContentAnnotations(object, stored)
+	s.setEncodingAnnotations(object)
+	setManagedLabel(object)
+
+	if err := s.save(client, object, exists); err != nil {
+		return err
+	}
+
+	referencedGenerations, err := s.pruneHistory(client, objectName(key))
+	if err != nil {
+		// Without knowing which chunks are referenced by history, no chunks can be safely deleted.
+		log.Printf("failed to prune history of state %s: %v", key, err)
+		return nil
+	}
+	if stored.manifest != nil {
+		referencedGenerations = append(referencedGenerations, stored.manifest.Generation)
+	}
+	s.deleteUnreferencedChunks(client, objectName(key), revision, referencedGenerations)
+	return nil
+}
+
+func (s *kubernetesStore) Delete(key Key, lockID string) error {
+	client := s.clientFor(key.Namespace)
+	revision := 0
+	err := retryOnConflict(func() error {
+		object, exists, err := s.get(client, key)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNotFound
+		}
+		revision = currentRevision(object)
+
+		// If the object is locked, then check the request comes from the locker.
+		if err := s.checkLockID(key, object, lockID); err != nil {
+			return err
+		}
+
+		// The deleted state is kept in history, subject to retention, so that it can still be rolled back to.
+		if err := s.saveHistory(client, object, objectName(key)); err != nil {
+			return err
+		}
+
+		// The precondition ensures the lock that was checked is still the current lock.
+		err = client.Delete(objectName(key),
+			&metav1.Preconditions{UID: &object.UID, ResourceVersion: &object.ResourceVersion})
+		if apierrors.IsNotFound(err) {
+			return ErrNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if s.options.LockMode == LockModeLease {
+		if err := s.unlockLease(key, nil); err != nil {
+			log.Printf("failed to delete lock of state %s: %v", key, err)
+		}
+	}
+	referencedGenerations, err := s.pruneHistory(client, objectName(key))
+	if err != nil {
+		// Without knowing which chunks are referenced by history, no chunks can be safely deleted.
+		log.Printf("failed to prune history of state %s: %v", key, err)
+		return nil
+	}
+	s.deleteUnreferencedChunks(client, objectName(key), revision+1, referencedGenerations)
+	return nil
+}
+
+func (s *kubernetesStore) Lock(key Key, info LockInfo) error {
+	if err := key.Validate(); err != nil {
+		return err
+	}
+	client := s.clientFor(key.Namespace)
+	return retryOnConflict(func() error {
+		object, exists, err := s.get(client, key)
+		if err != nil {
+			return err
+		}
+
+		if s.options.LockMode == LockModeLease {
+			if err := s.lockLease(key, info); err != nil {
+				return err
+			}
+			// The state is created when it is locked, regardless of lock mode.
+			if exists {
+				return nil
+			}
+			return s.save(client, object, exists)
+		}
+
+		if current := lockInfoFromObject(object); current != nil && current.ID != info.ID {
+			return &LockedError{Lock: *current}
+		}
+
+		setLock(object, info)
+		return s.save(client, object, exists)
+	})
+}
+
+func (s *kubernetesStore) Unlock(key Key, info *LockInfo) error {
+	client := s.clientFor(key.Namespace)
+	return retryOnConflict(func() error {
+		object, exists, err := s.get(client, key)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNotFound
+		}
+
+		if s.options.LockMode == LockModeLease {
+			return s.unlockLease(key, info)
+		}
+
+		if current := lockInfoFromObject(object); info != nil && current != nil && current.ID != info.ID {
+			return &LockedError{Lock: *current}
+		}
+
+		clearLock(object)
+		return s.save(client, object, exists)
+	})
+}
+
+// checkLockID returns a *LockedError if lockID does not match the current lock ID.
+func (s *kubernetesStore) checkLockID(key Key, object *stateObject, lockID string) error {
+	if s.options.LockMode == LockModeLease {
+		return s.checkLeaseLockID(key, lockID)
+	}
+	return checkLockID(object, lockID)
+}
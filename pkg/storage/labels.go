@@ -0,0 +1,71 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// labelValueHashPrefix prefixes the hashed label values of names that cannot be used as label values.
+const labelValueHashPrefix = "sha256-"
+
+// labelValue returns the value used to label objects with name. Names that are not valid label values, e.g. because
+// they are longer than 63 characters, are hashed. Names that look like hashed values are also hashed, so that no two
+// names share a label value.
+func labelValue(name string) string {
+	if len(validation.IsValidLabelValue(name)) == 0 && !strings.HasPrefix(name, labelValueHashPrefix) {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	return labelValueHashPrefix + hex.EncodeToString(sum[:])[:validation.LabelValueMaxLength-len(labelValueHashPrefix)]
+}
+
+// setNameLabel labels object with name. If the label value is hashed then name is also stored in an annotation with
+// the same key, so that it can be read by nameLabel.
+func setNameLabel(object *metav1.ObjectMeta, key, name string) {
+	if object.Labels == nil {
+		object.Labels = make(map[string]string, 1)
+	}
+	value := labelValue(name)
+	object.Labels[key] = value
+	if value != name {
+		if object.Annotations == nil {
+			object.Annotations = make(map[string]string, 1)
+		}
+		object.Annotations[key] = name
+	}
+}
+
+// nameLabel returns the name object is labelled with by setNameLabel, and whether the label is set.
+func nameLabel(object metav1.ObjectMeta, key string) (string, bool) {
+	value, ok := object.Labels[key]
+	if name, hashed := object.Annotations[key]; ok && hashed && labelValue(name) == value {
+		return name, true
+	}
+	return value, ok
+}
+
+// nameSelector returns a label selector matching the objects labelled with name by setNameLabel.
+func nameSelector(key, name string) labels.Selector {
+	return labels.SelectorFromSet(labels.Set{key: labelValue(name)})
+}
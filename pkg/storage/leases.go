@@ -0,0 +1,226 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// LockModeAnnotations stores locks as annotations on the object storing the state. Locks never expire.
+	LockModeAnnotations = "annotations"
+	// LockModeLease stores locks in coordination.k8s.io/v1 Lease objects. Locks expire if they are not renewed by the
+	// lock holder within the lock TTL.
+	LockModeLease = "lease"
+
+	// DefaultLockTTL is the default duration after which a lease lock expires if it is not renewed.
+	DefaultLockTTL = 15 * time.Minute
+
+	labelKeyLockOf = annotationKeyPrefix + "lock-of"
+)
+
+// LockModes lists all supported lock modes.
+var LockModes = []string{LockModeAnnotations, LockModeLease}
+
+// leaseName returns the name of the lease used to lock a state. The resource is included so that states of the same
+// name stored in different resources do not share a lock.
+func (s *kubernetesStore) leaseName(name string) string {
+	return fmt.Sprintf("%s-%s-lock", name, s.resource)
+}
+
+// getLease returns the lease locking the state, or nil if the state is not locked.
+func (s *kubernetesStore) getLease(key Key) (*coordinationv1.Lease, error) {
+	lease, err := s.leases.Leases(key.Namespace).Get(s.leaseName(objectName(key)), metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return lease, nil
+}
+
+func lockInfoFromLease(lease *coordinationv1.Lease) *LockInfo {
+	info := &LockInfo{
+		Operation: lease.Annotations[annotationKeyLockOperation],
+		Info:      lease.Annotations[annotationKeyLockInfo],
+		Who:       lease.Annotations[annotationKeyLockWho],
+	}
+	if lease.Spec.HolderIdentity != nil {
+		info.ID = *lease.Spec.HolderIdentity
+	}
+	if lease.Spec.AcquireTime != nil {
+		info.Created = lease.Spec.AcquireTime.Time
+	}
+	return info
+}
+
+// leaseExpiry returns when the lease expires if it is not renewed.
+func leaseExpiry(lease *coordinationv1.Lease) time.Time {
+	var renewed time.Time
+	switch {
+	case lease.Spec.RenewTime != nil:
+		renewed = lease.Spec.RenewTime.Time
+	case lease.Spec.AcquireTime != nil:
+		renewed = lease.Spec.AcquireTime.Time
+	default:
+		renewed = lease.CreationTimestamp.Time
+	}
+	var duration time.Duration
+	if lease.Spec.LeaseDurationSeconds != nil {
+		duration = time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	}
+	return renewed.Add(duration)
+}
+
+// currentLeaseLock returns the lease and the lock it holds, or nil if the state is not locked or the lock has expired.
+func (s *kubernetesStore) currentLeaseLock(key Key) (*coordinationv1.Lease, *LockInfo, error) {
+	lease, err := s.getLease(key)
+	if err != nil || lease == nil {
+		return nil, nil, err
+	}
+	info := lockInfoFromLease(lease)
+	if expiry := leaseExpiry(lease); time.Now().After(expiry) {
+		log.Printf("lock on state %s with lock ID %q held by %q expired at %s",
+			key, info.ID, info.Who, expiry.Format(time.RFC3339))
+		return lease, nil, nil
+	}
+	return lease, info, nil
+}
+
+// setLeaseLock updates the lease to be held by the lock.
+func (s *kubernetesStore) setLeaseLock(lease *coordinationv1.Lease, info LockInfo) {
+	if lease.Annotations == nil {
+		lease.Annotations = make(map[string]string, 3)
+	}
+	lease.Annotations[annotationKeyLockOperation] = info.Operation
+	lease.Annotations[annotationKeyLockInfo] = info.Info
+	lease.Annotations[annotationKeyLockWho] = info.Who
+
+	now := metav1.NewMicroTime(time.Now())
+	ttlSeconds := int32(s.options.LockTTL / time.Second)
+	id := info.ID
+	lease.Spec.HolderIdentity = &id
+	lease.Spec.LeaseDurationSeconds = &ttlSeconds
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+}
+
+// renewLease extends the lease by the lock TTL.
+func (s *kubernetesStore) renewLease(key Key, lease *coordinationv1.Lease) error {
+	now := metav1.NewMicroTime(time.Now())
+	ttlSeconds := int32(s.options.LockTTL / time.Second)
+	lease.Spec.RenewTime = &now
+	lease.Spec.LeaseDurationSeconds = &ttlSeconds
+	_, err := s.leases.Leases(key.Namespace).Update(lease)
+	return err
+}
+
+// lockLease acquires the lease for the lock. If the lease is already held with the same lock ID it is renewed, and if
+// it is held by another lock that has expired then it is reclaimed.
+func (s *kubernetesStore) lockLease(key Key, info LockInfo) error {
+	lease, current, err := s.currentLeaseLock(key)
+	if err != nil {
+		return err
+	}
+
+	if lease == nil {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      s.leaseName(objectName(key)),
+				Namespace: key.Namespace,
+			},
+		}
+		setNameLabel(&lease.ObjectMeta, labelKeyLockOf, objectName(key))
+		setWorkspaceLabels(&lease.ObjectMeta, key)
+		s.setLeaseLock(lease, info)
+		_, err := s.leases.Leases(key.Namespace).Create(lease)
+		return err
+	}
+
+	if current != nil {
+		if current.ID != info.ID {
+			return &LockedError{Lock: *current}
+		}
+		return s.renewLease(key, lease)
+	}
+
+	previous := lockInfoFromLease(lease)
+	log.Printf("reclaiming expired lock on state %s with lock ID %q held by %q", key, previous.ID, previous.Who)
+	s.setLeaseLock(lease, info)
+	transitions := int32(1)
+	if lease.Spec.LeaseTransitions != nil {
+		transitions += *lease.Spec.LeaseTransitions
+	}
+	lease.Spec.LeaseTransitions = &transitions
+	_, err = s.leases.Leases(key.Namespace).Update(lease)
+	return err
+}
+
+// unlockLease releases the lease. If info is nil then the lease is released regardless of the lock holder.
+func (s *kubernetesStore) unlockLease(key Key, info *LockInfo) error {
+	lease, current, err := s.currentLeaseLock(key)
+	if err != nil || lease == nil {
+		return err
+	}
+	if info != nil && current != nil && current.ID != info.ID {
+		return &LockedError{Lock: *current}
+	}
+	return s.deleteLease(key, lease)
+}
+
+// deleteLease deletes the lease, provided it has not been modified since it was read.
+func (s *kubernetesStore) deleteLease(key Key, lease *coordinationv1.Lease) error {
+	err := s.leases.Leases(key.Namespace).Delete(lease.Name, &metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &lease.UID, ResourceVersion: &lease.ResourceVersion},
+	})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// checkLeaseLockID returns a *LockedError if lockID does not match the current lock ID, including if the state is not
+// locked but a lock ID is specified. A matching lock is renewed, as is an expired lock that has not been reclaimed.
+func (s *kubernetesStore) checkLeaseLockID(key Key, lockID string) error {
+	lease, current, err := s.currentLeaseLock(key)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case lockID != "" && lease != nil && lockInfoFromLease(lease).ID == lockID:
+		if err := s.renewLease(key, lease); err != nil {
+			log.Printf("failed to renew lock on state %s: %v", key, err)
+		}
+		return nil
+	case lockID == "" && current == nil:
+		return nil
+	}
+
+	lockedErr := &LockedError{}
+	if current != nil {
+		lockedErr.Lock = *current
+	}
+	return lockedErr
+}
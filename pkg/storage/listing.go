@@ -0,0 +1,157 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+const labelKeyManaged = annotationKeyPrefix + "managed"
+
+// setManagedLabel labels an object storing state so that all states can be listed.
+func setManagedLabel(object *stateObject) {
+	if object.Labels == nil {
+		object.Labels = make(map[string]string, 1)
+	}
+	object.Labels[labelKeyManaged] = "true"
+}
+
+// keyOf returns the key of the state stored in, or locked by, the object of the named state, using the labels set by
+// setWorkspaceLabels.
+func keyOf(object metav1.ObjectMeta, name string) Key {
+	key := Key{Namespace: object.Namespace, Name: name, Workspace: DefaultWorkspace}
+	if workspaceOf, ok := nameLabel(object, labelKeyWorkspaceOf); ok {
+		key.Name = workspaceOf
+		key.Workspace, _ = nameLabel(object, labelKeyWorkspace)
+	}
+	return key
+}
+
+// stateInfo returns the description of the state stored in object, recorded in its annotations on write.
+func stateInfo(object *stateObject) StateInfo {
+	key := keyOf(object.ObjectMeta, object.Name)
+	info := StateInfo{
+		Name:             key.Name,
+		Workspace:        key.Workspace,
+		Lineage:          object.Annotations[annotationKeyLineage],
+		TerraformVersion: object.Annotations[annotationKeyTerraformVersion],
+		LastModified:     object.CreationTimestamp.Time,
+		Lock:             lockInfoFromObject(object),
+	}
+	info.Size, _ = strconv.ParseInt(object.Annotations[annotationKeySize], 10, 64)
+	info.Serial, _ = strconv.ParseUint(object.Annotations[annotationKeySerial], 10, 64)
+	if lastModified, err := time.Parse(time.RFC3339, object.Annotations[annotationKeyLastModified]); err == nil {
+		info.LastModified = lastModified
+	}
+	return info
+}
+
+func (s *kubernetesStore) List(namespace string) ([]StateInfo, error) {
+	selector := labels.SelectorFromSet(labels.Set{labelKeyManaged: "true"})
+	objects, err := s.clientFor(namespace).List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+
+	var leases map[string]*coordinationv1.Lease
+	if s.options.LockMode == LockModeLease {
+		list, err := s.listLeases(namespace)
+		if err != nil {
+			return nil, err
+		}
+		leases = make(map[string]*coordinationv1.Lease, len(list))
+		for i := range list {
+			leases[list[i].Name] = &list[i]
+		}
+	}
+
+	states := make([]StateInfo, 0, len(objects))
+	for _, object := range objects {
+		info := stateInfo(object)
+		if s.options.LockMode == LockModeLease {
+			info.Lock = nil
+			if lease, ok := leases[s.leaseName(object.Name)]; ok && time.Now().Before(leaseExpiry(lease)) {
+				info.Lock = lockInfoFromLease(lease)
+			}
+		}
+		states = append(states, info)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Name != states[j].Name {
+			return states[i].Name < states[j].Name
+		}
+		return states[i].Workspace < states[j].Workspace
+	})
+	return states, nil
+}
+
+// listLeases returns the leases locking states in the namespace, or in all namespaces if namespace is empty. Leases of
+// states stored in other resources are included.
+func (s *kubernetesStore) listLeases(namespace string) ([]coordinationv1.Lease, error) {
+	requirement, err := labels.NewRequirement(labelKeyLockOf, selection.Exists, nil)
+	if err != nil {
+		return nil, err
+	}
+	list, err := s.leases.Leases(namespace).List(metav1.ListOptions{
+		LabelSelector: labels.NewSelector().Add(*requirement).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+var _ LockLister = &kubernetesStore{}
+
+func (s *kubernetesStore) ListLocks(namespace string) ([]LockedState, error) {
+	var locks []LockedState
+	if s.options.LockMode == LockModeLease {
+		leases, err := s.listLeases(namespace)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		for i := range leases {
+			lease := &leases[i]
+			name, _ := nameLabel(lease.ObjectMeta, labelKeyLockOf)
+			if lease.Name != s.leaseName(name) || now.After(leaseExpiry(lease)) {
+				continue
+			}
+			locks = append(locks, LockedState{Key: keyOf(lease.ObjectMeta, name), Lock: *lockInfoFromLease(lease)})
+		}
+		return locks, nil
+	}
+
+	selector := labels.SelectorFromSet(labels.Set{labelKeyLocked: "true"})
+	objects, err := s.clientFor(namespace).List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range objects {
+		if info := lockInfoFromObject(object); info != nil {
+			locks = append(locks, LockedState{Key: keyOf(object.ObjectMeta, object.Name), Lock: *info})
+		}
+	}
+	return locks, nil
+}
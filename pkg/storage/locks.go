@@ -0,0 +1,88 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import "time"
+
+const (
+	annotationKeyPrefix        = "tf-kubernetes-configmap-backend.jimmidyson.github.com/"
+	annotationKeyLockID        = annotationKeyPrefix + "lock-id"
+	annotationKeyLockOperation = annotationKeyPrefix + "lock-operation"
+	annotationKeyLockInfo      = annotationKeyPrefix + "lock-info"
+	annotationKeyLockWho       = annotationKeyPrefix + "lock-who"
+	annotationKeyLockCreated   = annotationKeyPrefix + "lock-created"
+
+	// labelKeyLocked labels locked objects, so that locks can be listed without listing every state.
+	labelKeyLocked = annotationKeyPrefix + "locked"
+)
+
+// lockInfoFromObject returns the lock stored in the object annotations, or nil if the object is not locked.
+func lockInfoFromObject(object *stateObject) *LockInfo {
+	if _, locked := object.Annotations[annotationKeyLockID]; !locked {
+		return nil
+	}
+	info := &LockInfo{
+		ID:        object.Annotations[annotationKeyLockID],
+		Operation: object.Annotations[annotationKeyLockOperation],
+		Info:      object.Annotations[annotationKeyLockInfo],
+		Who:       object.Annotations[annotationKeyLockWho],
+	}
+	info.Created, _ = time.Parse(time.RFC3339, object.Annotations[annotationKeyLockCreated])
+	return info
+}
+
+// checkLockID returns a *LockedError if lockID does not match the current lock ID, including if the object is not
+// locked but a lock ID is specified.
+func checkLockID(object *stateObject, lockID string) error {
+	if object.Annotations[annotationKeyLockID] == lockID {
+		return nil
+	}
+	lockedErr := &LockedError{}
+	if current := lockInfoFromObject(object); current != nil {
+		lockedErr.Lock = *current
+	}
+	return lockedErr
+}
+
+// setLock stores the lock in the object annotations. Re-acquiring a lock that is already held keeps the time it was
+// created.
+func setLock(object *stateObject, info LockInfo) {
+	if object.Annotations == nil {
+		object.Annotations = make(map[string]string, 5)
+	}
+	if object.Labels == nil {
+		object.Labels = make(map[string]string, 1)
+	}
+
+	if current := lockInfoFromObject(object); current == nil || current.ID != info.ID || current.Created.IsZero() {
+		object.Annotations[annotationKeyLockCreated] = time.Now().UTC().Format(time.RFC3339)
+	}
+	object.Annotations[annotationKeyLockID] = info.ID
+	object.Annotations[annotationKeyLockOperation] = info.Operation
+	object.Annotations[annotationKeyLockInfo] = info.Info
+	object.Annotations[annotationKeyLockWho] = info.Who
+	object.Labels[labelKeyLocked] = "true"
+}
+
+func clearLock(object *stateObject) {
+	delete(object.Annotations, annotationKeyLockID)
+	delete(object.Annotations, annotationKeyLockOperation)
+	delete(object.Annotations, annotationKeyLockInfo)
+	delete(object.Annotations, annotationKeyLockWho)
+	delete(object.Annotations, annotationKeyLockCreated)
+	delete(object.Labels, labelKeyLocked)
+}
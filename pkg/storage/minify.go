@@ -0,0 +1,60 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"io"
+)
+
+// jsonMinifier removes insignificant whitespace from JSON written to it, without buffering the JSON document so that
+// arbitrarily large states can be minified as a stream. The JSON is not validated.
+type jsonMinifier struct {
+	w        io.Writer
+	buf      []byte
+	inString bool
+	escaped  bool
+}
+
+func newJSONMinifier(w io.Writer) *jsonMinifier {
+	return &jsonMinifier{w: w}
+}
+
+func (m *jsonMinifier) Write(p []byte) (int, error) {
+	m.buf = m.buf[:0]
+	for _, c := range p {
+		switch {
+		case m.inString:
+			switch {
+			case m.escaped:
+				m.escaped = false
+			case c == '\\':
+				m.escaped = true
+			case c == '"':
+				m.inString = false
+			}
+		case c == '"':
+			m.inString = true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			continue
+		}
+		m.buf = append(m.buf, c)
+	}
+	if _, err := m.w.Write(m.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,254 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/metrics"
+)
+
+const (
+	// ResourceConfigMaps stores Terraform state in configmaps.
+	ResourceConfigMaps = "configmaps"
+	// ResourceSecrets stores Terraform state in secrets.
+	ResourceSecrets = "secrets"
+)
+
+// Resources lists all Kubernetes resources that can be used to store Terraform state.
+var Resources = []string{ResourceConfigMaps, ResourceSecrets}
+
+// stateObject holds the parts of a configmap or secret that are used to store Terraform state.
+type stateObject struct {
+	metav1.ObjectMeta
+	Data map[string][]byte
+	// original is the configmap or secret the object was read from, so that its fields that are not used to store
+	// state are kept on update.
+	original runtime.Object
+}
+
+// objectClient abstracts the Kubernetes API calls made against the objects used to store Terraform state.
+type objectClient interface {
+	Get(name string) (*stateObject, error)
+	List(listOptions metav1.ListOptions) ([]*stateObject, error)
+	Create(object *stateObject) (*stateObject, error)
+	Update(object *stateObject) (*stateObject, error)
+	// Delete deletes the named object. If preconditions is not nil then the object is only deleted if it matches.
+	Delete(name string, preconditions *metav1.Preconditions) error
+	DeleteCollection(listOptions metav1.ListOptions) error
+}
+
+// objectClientFactory returns an objectClient for the specified namespace.
+type objectClientFactory func(namespace string) objectClient
+
+func newObjectClientFactory(coreClient corev1.CoreV1Interface, resource string) (objectClientFactory, error) {
+	switch resource {
+	case ResourceConfigMaps:
+		return func(namespace string) objectClient {
+			client := configMapObjectClient{client: coreClient.ConfigMaps(namespace)}
+			return instrumentedObjectClient{client: client, resource: resource}
+		}, nil
+	case ResourceSecrets:
+		return func(namespace string) objectClient {
+			client := secretObjectClient{client: coreClient.Secrets(namespace)}
+			return instrumentedObjectClient{client: client, resource: resource}
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported resource: %s", resource)
+	}
+}
+
+// instrumentedObjectClient counts the errors returned by client in metrics.KubernetesAPIErrorsTotal.
+type instrumentedObjectClient struct {
+	client   objectClient
+	resource string
+}
+
+func (c instrumentedObjectClient) observe(verb string, err error) {
+	if err != nil {
+		metrics.KubernetesAPIErrorsTotal.WithLabelValues(c.resource, verb, string(apierrors.ReasonForError(err))).Inc()
+	}
+}
+
+func (c instrumentedObjectClient) Get(name string) (*stateObject, error) {
+	object, err := c.client.Get(name)
+	c.observe("get", err)
+	return object, err
+}
+
+func (c instrumentedObjectClient) List(listOptions metav1.ListOptions) ([]*stateObject, error) {
+	objects, err := c.client.List(listOptions)
+	c.observe("list", err)
+	return objects, err
+}
+
+func (c instrumentedObjectClient) Create(object *stateObject) (*stateObject, error) {
+	object, err := c.client.Create(object)
+	c.observe("create", err)
+	return object, err
+}
+
+func (c instrumentedObjectClient) Update(object *stateObject) (*stateObject, error) {
+	object, err := c.client.Update(object)
+	c.observe("update", err)
+	return object, err
+}
+
+func (c instrumentedObjectClient) Delete(name string, preconditions *metav1.Preconditions) error {
+	err := c.client.Delete(name, preconditions)
+	c.observe("delete", err)
+	return err
+}
+
+func (c instrumentedObjectClient) DeleteCollection(listOptions metav1.ListOptions) error {
+	err := c.client.DeleteCollection(listOptions)
+	c.observe("deletecollection", err)
+	return err
+}
+
+type configMapObjectClient struct {
+	client corev1.ConfigMapInterface
+}
+
+func (c configMapObjectClient) Get(name string) (*stateObject, error) {
+	configMap, err := c.client.Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return configMapToStateObject(configMap), nil
+}
+
+func (c configMapObjectClient) List(listOptions metav1.ListOptions) ([]*stateObject, error) {
+	configMapList, err := c.client.List(listOptions)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]*stateObject, 0, len(configMapList.Items))
+	for i := range configMapList.Items {
+		objects = append(objects, configMapToStateObject(&configMapList.Items[i]))
+	}
+	return objects, nil
+}
+
+func (c configMapObjectClient) Create(object *stateObject) (*stateObject, error) {
+	configMap, err := c.client.Create(stateObjectToConfigMap(object))
+	if err != nil {
+		return nil, err
+	}
+	return configMapToStateObject(configMap), nil
+}
+
+func (c configMapObjectClient) Update(object *stateObject) (*stateObject, error) {
+	configMap, err := c.client.Update(stateObjectToConfigMap(object))
+	if err != nil {
+		return nil, err
+	}
+	return configMapToStateObject(configMap), nil
+}
+
+func (c configMapObjectClient) Delete(name string, preconditions *metav1.Preconditions) error {
+	return c.client.Delete(name, &metav1.DeleteOptions{Preconditions: preconditions})
+}
+
+func (c configMapObjectClient) DeleteCollection(listOptions metav1.ListOptions) error {
+	return c.client.DeleteCollection(&metav1.DeleteOptions{}, listOptions)
+}
+
+func configMapToStateObject(configMap *v1.ConfigMap) *stateObject {
+	return &stateObject{ObjectMeta: configMap.ObjectMeta, Data: configMap.BinaryData, original: configMap}
+}
+
+// stateObjectToConfigMap returns the configmap storing object, keeping the data of the configmap it was read from.
+func stateObjectToConfigMap(object *stateObject) *v1.ConfigMap {
+	var configMap v1.ConfigMap
+	if original, ok := object.original.(*v1.ConfigMap); ok {
+		configMap = *original
+	}
+	configMap.ObjectMeta = object.ObjectMeta
+	configMap.BinaryData = object.Data
+	return &configMap
+}
+
+type secretObjectClient struct {
+	client corev1.SecretInterface
+}
+
+func (c secretObjectClient) Get(name string) (*stateObject, error) {
+	secret, err := c.client.Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return secretToStateObject(secret), nil
+}
+
+func (c secretObjectClient) List(listOptions metav1.ListOptions) ([]*stateObject, error) {
+	secretList, err := c.client.List(listOptions)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]*stateObject, 0, len(secretList.Items))
+	for i := range secretList.Items {
+		objects = append(objects, secretToStateObject(&secretList.Items[i]))
+	}
+	return objects, nil
+}
+
+func (c secretObjectClient) Create(object *stateObject) (*stateObject, error) {
+	secret, err := c.client.Create(stateObjectToSecret(object))
+	if err != nil {
+		return nil, err
+	}
+	return secretToStateObject(secret), nil
+}
+
+func (c secretObjectClient) Update(object *stateObject) (*stateObject, error) {
+	secret, err := c.client.Update(stateObjectToSecret(object))
+	if err != nil {
+		return nil, err
+	}
+	return secretToStateObject(secret), nil
+}
+
+func (c secretObjectClient) Delete(name string, preconditions *metav1.Preconditions) error {
+	return c.client.Delete(name, &metav1.DeleteOptions{Preconditions: preconditions})
+}
+
+func (c secretObjectClient) DeleteCollection(listOptions metav1.ListOptions) error {
+	return c.client.DeleteCollection(&metav1.DeleteOptions{}, listOptions)
+}
+
+func secretToStateObject(secret *v1.Secret) *stateObject {
+	return &stateObject{ObjectMeta: secret.ObjectMeta, Data: secret.Data, original: secret}
+}
+
+// stateObjectToSecret returns the secret storing object, keeping the type of the secret it was read from. New secrets
+// are opaque.
+func stateObjectToSecret(object *stateObject) *v1.Secret {
+	secret := v1.Secret{Type: v1.SecretTypeOpaque}
+	if original, ok := object.original.(*v1.Secret); ok {
+		secret = *original
+	}
+	secret.ObjectMeta = object.ObjectMeta
+	secret.Data = object.Data
+	return &secret
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testState = `{"version": 4, "serial": 1, "lineage": "test", "outputs": {}}`
+
+func TestUpdateKeepsForeignFields(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "state", Namespace: "default"},
+			Data:       map[string]string{"note": "kept"},
+		},
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "state", Namespace: "default"},
+			Type:       "example.com/state",
+			Data:       map[string][]byte{"note": []byte("kept")},
+		},
+	)
+	for _, resource := range Resources {
+		store, err := NewKubernetesStore(client, resource, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := Key{Namespace: "default", Name: "state"}
+		if err := store.Put(key, strings.NewReader(testState), PutOptions{}); err != nil {
+			t.Fatalf("%s: %v", resource, err)
+		}
+	}
+
+	configMap, err := client.CoreV1().ConfigMaps("default").Get("state", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configMap.Data["note"] != "kept" || len(configMap.BinaryData[dataKeyTFState]) == 0 {
+		t.Errorf("expected configmap data to be kept alongside state, got %v", configMap.Data)
+	}
+	secret, err := client.CoreV1().Secrets("default").Get("state", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.Type != "example.com/state" || string(secret.Data["note"]) != "kept" ||
+		len(secret.Data[dataKeyTFState]) == 0 {
+		t.Errorf("expected secret type and data to be kept alongside state, got %s %v", secret.Type, secret.Data)
+	}
+
+	// New secrets are opaque.
+	store, err := NewKubernetesStore(client, ResourceSecrets, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(Key{Namespace: "default", Name: "new"}, strings.NewReader(testState), PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if secret, err := client.CoreV1().Secrets("default").Get("new", metav1.GetOptions{}); err != nil {
+		t.Fatal(err)
+	} else if secret.Type != v1.SecretTypeOpaque {
+		t.Errorf("expected new secret to be opaque, got %s", secret.Type)
+	}
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/tfstate"
+)
+
+const (
+	// AnnotationKeyOutputsConfigMap is the annotation on the object storing a state that names the configmap that
+	// non-sensitive outputs are projected into. Defaults to <name>-outputs.
+	AnnotationKeyOutputsConfigMap = annotationKeyPrefix + "outputs-configmap"
+	// AnnotationKeyOutputsSecret is the annotation on the object storing a state that names the secret that sensitive
+	// outputs are projected into. Defaults to <name>-outputs.
+	AnnotationKeyOutputsSecret = annotationKeyPrefix + "outputs-secret"
+
+	labelKeyOutputsOf = annotationKeyPrefix + "outputs-of"
+)
+
+// output is a root module output of a Terraform state.
+type output struct {
+	Value     json.RawMessage `json:"value"`
+	Sensitive bool            `json:"sensitive"`
+}
+
+// outputValue returns the value of an output as stored in a configmap or secret: strings are stored as is, all other
+// values as JSON.
+func outputValue(value json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		return s
+	}
+	return string(value)
+}
+
+// kindOf returns the kind of the objects of a resource in Resources.
+func kindOf(resource string) string {
+	if resource == ResourceSecrets {
+		return "Secret"
+	}
+	return "ConfigMap"
+}
+
+// projectOutputs writes the non-sensitive outputs of the state to a configmap and its sensitive outputs to a secret,
+// owned by the object storing the state so that they are deleted with the state. Errors are only logged as the state
+// itself has already been written successfully.
+func (s *kubernetesStore) projectOutputs(client objectClient, key Key) {
+	object, exists, err := s.get(client, key)
+	if err != nil || !exists || !hasTFState(object) {
+		if err != nil {
+			log.Printf("failed to get state %s to project outputs: %v", key, err)
+		}
+		return
+	}
+	r, err := s.openState(client, object, objectName(key))
+	if err != nil {
+		log.Printf("failed to read state %s to project outputs: %v", key, err)
+		return
+	}
+	defer r.Close()
+	state, err := tfstate.ReadOutputs(r)
+	if err != nil {
+		log.Printf("failed to read outputs of state %s: %v", key, err)
+		return
+	}
+	outputs := map[string]output{}
+	if err := json.Unmarshal(state.Outputs, &outputs); err != nil {
+		log.Printf("failed to read outputs of state %s: %v", key, err)
+		return
+	}
+
+	values := make(map[string]string, len(outputs))
+	sensitiveValues := make(map[string][]byte, len(outputs))
+	for name, output := range outputs {
+		if output.Sensitive {
+			sensitiveValues[name] = []byte(outputValue(output.Value))
+		} else {
+			values[name] = outputValue(output.Value)
+		}
+	}
+
+	meta := metav1.ObjectMeta{
+		Namespace: key.Namespace,
+		Labels:    map[string]string{labelKeyOutputsOf: labelValue(object.Name)},
+		OwnerReferences: []metav1.OwnerReference{{
+			APIVersion: "v1",
+			Kind:       kindOf(s.resource),
+			Name:       object.Name,
+			UID:        object.UID,
+		}},
+	}
+	configMapName, secretName := object.Name+"-outputs", object.Name+"-outputs"
+	if name, ok := object.Annotations[AnnotationKeyOutputsConfigMap]; ok {
+		configMapName = name
+	}
+	if name, ok := object.Annotations[AnnotationKeyOutputsSecret]; ok {
+		secretName = name
+	}
+
+	configMap := &v1.ConfigMap{ObjectMeta: *meta.DeepCopy(), Data: values}
+	configMap.Name = configMapName
+	if err := retryOnConflict(func() error { return s.writeOutputsConfigMap(configMap) }); err != nil {
+		log.Printf("failed to project outputs of state %s to configmap %s: %v", key, configMapName, err)
+	}
+	secret := &v1.Secret{ObjectMeta: *meta.DeepCopy(), Data: sensitiveValues}
+	secret.Name = secretName
+	if err := retryOnConflict(func() error { return s.writeOutputsSecret(secret) }); err != nil {
+		log.Printf("failed to project outputs of state %s to secret %s: %v", key, secretName, err)
+	}
+}
+
+// writeOutputsConfigMap creates or updates the configmap holding projected outputs. Existing configmaps that do not
+// hold the outputs of the same state are never overwritten.
+func (s *kubernetesStore) writeOutputsConfigMap(configMap *v1.ConfigMap) error {
+	configMaps := s.core.ConfigMaps(configMap.Namespace)
+	existing, err := configMaps.Get(configMap.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = configMaps.Create(configMap)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if existing.Labels[labelKeyOutputsOf] != configMap.Labels[labelKeyOutputsOf] {
+		return fmt.Errorf("configmap %s does not hold projected outputs", configMap.Name)
+	}
+	configMap.ResourceVersion = existing.ResourceVersion
+	_, err = configMaps.Update(configMap)
+	return err
+}
+
+// writeOutputsSecret creates or updates the secret holding projected sensitive outputs. Existing secrets that do not
+// hold the outputs of the same state are never overwritten.
+func (s *kubernetesStore) writeOutputsSecret(secret *v1.Secret) error {
+	secrets := s.core.Secrets(secret.Namespace)
+	existing, err := secrets.Get(secret.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = secrets.Create(secret)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if existing.Labels[labelKeyOutputsOf] != secret.Labels[labelKeyOutputsOf] {
+		return fmt.Errorf("secret %s does not hold projected outputs", secret.Name)
+	}
+	secret.ResourceVersion = existing.ResourceVersion
+	_, err = secrets.Update(secret)
+	return err
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/encryption"
+)
+
+var _ KeyRotator = &kubernetesStore{}
+
+// needsReencryption returns true if encryption is enabled and the stored state read by br is not encrypted with the
+// current key. Only the start of the stored state is peeked, so br can still be used to read the state.
+func (s *kubernetesStore) needsReencryption(br *bufio.Reader) bool {
+	if s.options.KeyProvider == nil {
+		return false
+	}
+	prefix, _ := br.Peek(br.Size())
+	if !encryption.IsEncrypted(prefix) {
+		return true
+	}
+	keyID, err := encryption.KeyIDOf(prefix)
+	return err == nil && keyID != s.options.KeyProvider.KeyID()
+}
+
+// stateName returns the name of the state that object stores, either as the primary object or as a history object.
+// Chunks are named after the state.
+func stateName(object *stateObject) string {
+	if name, ok := nameLabel(object.ObjectMeta, labelKeyHistoryOf); ok {
+		return name
+	}
+	return object.Name
+}
+
+// reencrypt rewrites the state stored in object with the current encryption key, without changing its revision. The
+// object is updated with the resourceVersion it was read with, so a concurrent write wins over re-encryption.
+//
+// Chunks of the previous encryption are not deleted, as they may have been copied to history by a concurrent write.
+// They are no longer referenced once the object is updated, and are removed along with the rest of their generation.
+func (s *kubernetesStore) reencrypt(client objectClient, object *stateObject) error {
+	name := stateName(object)
+	stored, err := s.readTFState(object, client, name)
+	if err != nil {
+		return err
+	}
+	decrypted, err := s.decryptState(stored)
+	if err != nil {
+		return err
+	}
+	reencrypted, err := s.writeTFState(client, object.Namespace, name, currentRevision(object), decrypted, s.encryptState)
+	if err != nil {
+		return err
+	}
+
+	updated := &stateObject{
+		ObjectMeta: *object.ObjectMeta.DeepCopy(),
+		Data:       make(map[string][]byte, len(object.Data)),
+		original:   object.original,
+	}
+	for k, v := range object.Data {
+		updated.Data[k] = v
+	}
+	if err := reencrypted.apply(updated); err != nil {
+		s.deleteChunkGeneration(client, name, reencrypted.manifest)
+		return err
+	}
+	if updated.Annotations == nil {
+		updated.Annotations = make(map[string]string, 1)
+	}
+	updated.Annotations[annotationKeyEncrypted] = "true"
+	if _, err := client.Update(updated); err != nil {
+		s.deleteChunkGeneration(client, name, reencrypted.manifest)
+		return err
+	}
+	return nil
+}
+
+// encryptState encrypts already encoded state read from r with the current encryption key, writing it to w.
+func (s *kubernetesStore) encryptState(r io.Reader, w io.Writer) error {
+	encw, err := encryption.NewWriter(w, s.options.KeyProvider)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(encw, r); err != nil {
+		return err
+	}
+	return encw.Close()
+}
+
+func (s *kubernetesStore) RotateEncryptionKeys(namespace string) (int, error) {
+	if s.options.KeyProvider == nil {
+		return 0, errors.New("encryption is not enabled")
+	}
+
+	// Chunks are re-encrypted as part of the object that references them.
+	notChunk, err := labels.NewRequirement(labelKeyChunkOf, selection.DoesNotExist, nil)
+	if err != nil {
+		return 0, err
+	}
+	objects, err := s.clientFor(namespace).List(metav1.ListOptions{
+		LabelSelector: labels.NewSelector().Add(*notChunk).String(),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	rotated, failed := 0, 0
+	for _, object := range objects {
+		if !hasTFState(object) {
+			continue
+		}
+		client := s.clientFor(object.Namespace)
+		stored, err := s.readTFState(object, client, stateName(object))
+		if err != nil {
+			log.Printf("failed to read state %s/%s: %v", object.Namespace, object.Name, err)
+			failed++
+			continue
+		}
+		if !s.needsReencryption(bufio.NewReaderSize(stored, headerPeekSize)) {
+			continue
+		}
+		if err := s.reencrypt(client, object); err != nil {
+			log.Printf("failed to re-encrypt state %s/%s: %v", object.Namespace, object.Name, err)
+			failed++
+			continue
+		}
+		rotated++
+	}
+	if failed > 0 {
+		return rotated, fmt.Errorf("failed to re-encrypt %d %s", failed, s.resource)
+	}
+	return rotated, nil
+}
@@ -0,0 +1,250 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/jimmidyson/tf-kubernetes-configmap-backend/pkg/tfstate"
+)
+
+var (
+	// ErrNotFound is returned when the requested state does not exist.
+	ErrNotFound = errors.New("state not found")
+	// ErrLocked is returned when a state is locked by another lock holder. Errors returned by StateStore
+	// implementations are of type *LockedError so that the current lock can be reported to the caller.
+	ErrLocked = errors.New("state locked")
+	// ErrConflict is returned when a write is rejected because the lineage or serial of the written state conflicts
+	// with the stored state. Errors returned by StateStore implementations are of type *ConflictError.
+	ErrConflict = errors.New("state conflict")
+	// ErrChecksumMismatch is returned when a write is rejected because the written state does not match the checksum
+	// provided by the writer, e.g. because it was truncated.
+	ErrChecksumMismatch = errors.New("state checksum mismatch")
+	// ErrCorrupt is returned when stored state does not match the checksum recorded when it was written.
+	ErrCorrupt = errors.New("stored state corrupt")
+	// ErrPreconditionFailed is returned when a write is rejected because the ETag of the stored state does not match
+	// any of the ETags required by the writer.
+	ErrPreconditionFailed = errors.New("state precondition failed")
+	// ErrInvalidKey is returned when a state cannot be stored under the requested key, e.g. because its name is too
+	// long.
+	ErrInvalidKey = errors.New("invalid state key")
+)
+
+// Key identifies a stored Terraform state.
+type Key struct {
+	Namespace string
+	Name      string
+	// Workspace is the Terraform workspace of the state. Empty is equivalent to DefaultWorkspace.
+	Workspace string
+}
+
+func (k Key) String() string {
+	if isDefaultWorkspace(k.Workspace) {
+		return k.Namespace + "/" + k.Name
+	}
+	return k.Namespace + "/" + k.Name + "/" + k.Workspace
+}
+
+// maxObjectNameLength is the maximum length of the name of an object storing state, leaving room for the suffixes of
+// the names of its chunk, history, lease and outputs objects.
+const maxObjectNameLength = validation.DNS1123SubdomainMaxLength - 64
+
+// Validate returns an error wrapping ErrInvalidKey if the state identified by k cannot be stored. It is only required
+// for writes, so that states stored under keys that are no longer valid can still be read and deleted.
+func (k Key) Validate() error {
+	name := objectName(k)
+	errs := validation.IsDNS1123Subdomain(name)
+	if len(name) > maxObjectNameLength {
+		errs = append(errs, validation.MaxLenError(maxObjectNameLength))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%w %s: object name %q: %s", ErrInvalidKey, k, name, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// LockInfo stores lock metadata.
+//
+// Copied and trimmed from https://github.com/hashicorp/terraform/blob/master/states/statemgr/locker.go#L110-L138
+type LockInfo struct {
+	// Unique ID for the lock.
+	ID string
+	// Terraform operation, provided by the caller.
+	Operation string
+	// Extra information to store with the lock, provided by the caller.
+	Info string
+	// user@hostname when available
+	Who string
+	// Time that the lock was taken, as recorded by the backend rather than provided by the caller.
+	Created time.Time
+}
+
+// LockedError is returned when a state is locked by another lock holder.
+type LockedError struct {
+	// Lock is the lock currently held on the state.
+	Lock LockInfo
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("state locked by %q (lock ID %q)", e.Lock.Who, e.Lock.ID)
+}
+
+// Is allows LockedError to be matched with errors.Is(err, ErrLocked).
+func (e *LockedError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// ConflictError is returned when a write is rejected because the written state has a different lineage or a lower
+// serial than the stored state.
+type ConflictError struct {
+	// Reason describes the conflict.
+	Reason string
+	// Stored is the header of the stored state.
+	Stored tfstate.Header
+	// Requested is the header of the rejected state.
+	Requested tfstate.Header
+}
+
+func (e *ConflictError) Error() string {
+	return e.Reason
+}
+
+// Is allows ConflictError to be matched with errors.Is(err, ErrConflict).
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// PutOptions configures a write of state.
+type PutOptions struct {
+	// LockID is the ID of the lock held by the writer, required if the state is locked.
+	LockID string
+	// Force skips checking that the lineage and serial of the written state follow on from the stored state.
+	Force bool
+	// ContentMD5 is the MD5 digest of the written state. If set, the write is rejected with ErrChecksumMismatch
+	// unless the state read matches it.
+	ContentMD5 []byte
+	// IfMatch lists ETags of the stored state that the write is conditional on, with "*" matching any stored state. If
+	// not nil, the write is rejected with ErrPreconditionFailed unless the stored state matches one of them.
+	IfMatch []string
+}
+
+// State is a stored Terraform state.
+type State struct {
+	// Lock is the lock currently held on the state, nil if the state is not locked.
+	Lock *LockInfo
+	// Open returns a reader for the Terraform state as originally written. It is nil if the state exists, e.g.
+	// because it has been locked, but no Terraform state has been written yet. The state is verified against its
+	// recorded checksum as it is read: if it does not match, reading fails with an error wrapping ErrCorrupt before
+	// the last bytes of the state are returned.
+	Open func() (io.ReadCloser, error)
+	// ETag identifies the content of the state, changing whenever the state is written. It is empty if no Terraform
+	// state has been written yet.
+	ETag string
+	// ContentLength is the size in bytes of the state returned by Open, or -1 if it is not known.
+	ContentLength int64
+}
+
+// Version describes a previous version of a state.
+type Version struct {
+	// Revision identifies the version, incremented on every write to the state.
+	Revision int `json:"revision"`
+	// Serial is the Terraform serial of the state.
+	Serial uint64 `json:"serial"`
+	// Lineage is the Terraform lineage of the state.
+	Lineage string `json:"lineage,omitempty"`
+	// Created is when the version was replaced by a newer version.
+	Created time.Time `json:"created"`
+}
+
+// StateInfo describes a stored state.
+type StateInfo struct {
+	// Name is the name of the state.
+	Name string `json:"name"`
+	// Workspace is the Terraform workspace of the state.
+	Workspace string `json:"workspace"`
+	// Size is the size in bytes of the state as written by Terraform.
+	Size int64 `json:"size"`
+	// Serial is the Terraform serial of the state.
+	Serial uint64 `json:"serial"`
+	// Lineage is the Terraform lineage of the state.
+	Lineage string `json:"lineage,omitempty"`
+	// TerraformVersion is the version of Terraform that wrote the state.
+	TerraformVersion string `json:"terraformVersion,omitempty"`
+	// LastModified is when the state was last written.
+	LastModified time.Time `json:"lastModified"`
+	// Lock is the lock currently held on the state, nil if the state is not locked.
+	Lock *LockInfo `json:"lock,omitempty"`
+}
+
+// StateStore stores Terraform state and locks.
+type StateStore interface {
+	// Resource returns the Kubernetes resource that stores state, used to authorize requests.
+	Resource() string
+	// Get returns the state, or ErrNotFound if it does not exist.
+	Get(key Key) (*State, error)
+	// Put writes the state, creating it if it does not exist. If the state is locked then the lock ID in options must
+	// match the current lock. Unless forced, a *ConflictError is returned if the written state has a different
+	// lineage or a lower serial than the stored state.
+	Put(key Key, state io.Reader, options PutOptions) error
+	// Delete deletes the state, or returns ErrNotFound if it does not exist. If the state is locked then lockID must
+	// match the current lock. The deleted state is kept as a previous version.
+	Delete(key Key, lockID string) error
+	// Lock locks the state, creating it if it does not exist. Locking a state that is already locked with the same
+	// lock ID succeeds.
+	Lock(key Key, info LockInfo) error
+	// Unlock unlocks the state, or returns ErrNotFound if it does not exist. If info is nil then the state is
+	// forcibly unlocked, otherwise the lock ID must match the current lock.
+	Unlock(key Key, info *LockInfo) error
+	// ListVersions returns the previous versions of the state, most recent first, or ErrNotFound if the state does
+	// not exist and has no previous versions. Previous versions are kept when the state is deleted.
+	ListVersions(key Key) ([]Version, error)
+	// GetVersion returns a previous version of the state, or ErrNotFound if it does not exist.
+	GetVersion(key Key, revision int) (*State, error)
+	// ListWorkspaces returns the sorted names of the workspaces of the named state, or ErrNotFound if the state has no
+	// workspaces.
+	ListWorkspaces(namespace, name string) ([]string, error)
+	// List returns all states, including all workspaces, in the namespace sorted by name and workspace.
+	List(namespace string) ([]StateInfo, error)
+}
+
+// LockedState is a lock held on a state.
+type LockedState struct {
+	Key  Key
+	Lock LockInfo
+}
+
+// LockLister is implemented by StateStores that can list the locks held on states without reading every state, e.g.
+// to export the age of held locks in metrics.
+type LockLister interface {
+	// ListLocks returns the locks currently held on states in the namespace, or in all namespaces if namespace is
+	// empty.
+	ListLocks(namespace string) ([]LockedState, error)
+}
+
+// KeyRotator is implemented by StateStores that encrypt stored state, to re-encrypt all stored state with the current
+// encryption key.
+type KeyRotator interface {
+	// RotateEncryptionKeys re-encrypts all states and previous versions in the namespace, or in all namespaces if
+	// namespace is empty, that are not encrypted with the current key. It returns the number of re-encrypted objects.
+	RotateEncryptionKeys(namespace string) (int, error)
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"fmt"
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// DefaultWorkspace is the Terraform workspace used when no workspace is specified. It is stored in the object named
+	// after the state, so that states written before workspaces were supported belong to the default workspace.
+	DefaultWorkspace = "default"
+
+	labelKeyWorkspaceOf = annotationKeyPrefix + "workspace-of"
+	labelKeyWorkspace   = annotationKeyPrefix + "workspace"
+)
+
+// isDefaultWorkspace returns true if workspace is the default workspace.
+func isDefaultWorkspace(workspace string) bool {
+	return workspace == "" || workspace == DefaultWorkspace
+}
+
+// objectName returns the name of the object storing the state identified by key.
+func objectName(key Key) string {
+	if isDefaultWorkspace(key.Workspace) {
+		return key.Name
+	}
+	return key.Name + "-workspace-" + key.Workspace
+}
+
+// setWorkspaceLabels labels an object storing the state of a non-default workspace, or the lease locking it, so that
+// the workspaces of a state can be listed and locks listed by workspace.
+func setWorkspaceLabels(object *metav1.ObjectMeta, key Key) {
+	if isDefaultWorkspace(key.Workspace) {
+		return
+	}
+	setNameLabel(object, labelKeyWorkspaceOf, key.Name)
+	setNameLabel(object, labelKeyWorkspace, key.Workspace)
+}
+
+// checkWorkspace returns an error wrapping ErrInvalidKey if object stores the state of a workspace other than the one
+// identified by key. The name of the object of a workspace can equal the name of another state, which must not be able
+// to read the workspace.
+func checkWorkspace(object *stateObject, key Key) error {
+	workspaceOf, _ := nameLabel(object.ObjectMeta, labelKeyWorkspaceOf)
+	workspace, _ := nameLabel(object.ObjectMeta, labelKeyWorkspace)
+	if isDefaultWorkspace(key.Workspace) {
+		if workspaceOf != "" {
+			return fmt.Errorf("%w %s: %s stores workspace %q of state %s", ErrInvalidKey, key, object.Name, workspace,
+				workspaceOf)
+		}
+		return nil
+	}
+	if workspaceOf != key.Name || workspace != key.Workspace {
+		return fmt.Errorf("%w %s: %s does not store workspace %q of state %s", ErrInvalidKey, key, object.Name,
+			key.Workspace, key.Name)
+	}
+	return nil
+}
+
+func (s *kubernetesStore) ListWorkspaces(namespace, name string) ([]string, error) {
+	client := s.clientFor(namespace)
+	var workspaces []string
+	if _, exists, err := s.get(client, Key{Namespace: namespace, Name: name}); err != nil {
+		return nil, err
+	} else if exists {
+		workspaces = append(workspaces, DefaultWorkspace)
+	}
+
+	selector := nameSelector(labelKeyWorkspaceOf, name)
+	objects, err := client.List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range objects {
+		workspace, _ := nameLabel(object.ObjectMeta, labelKeyWorkspace)
+		workspaces = append(workspaces, workspace)
+	}
+	if len(workspaces) == 0 {
+		return nil, ErrNotFound
+	}
+	sort.Strings(workspaces)
+	return workspaces, nil
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tfstate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// OutputsState is a Terraform state holding only the outputs of another state, without any resources. It is a valid
+// state that can be read by terraform_remote_state.
+type OutputsState struct {
+	Header
+	// Outputs are the root module outputs of the state.
+	Outputs json.RawMessage `json:"outputs"`
+	// Resources is always empty.
+	Resources []struct{} `json:"resources"`
+}
+
+// ReadOutputs reads the header and outputs of a Terraform state. Only the outputs are held in memory: all other fields,
+// including resources, are skipped as they are read. Only version 4 states, written by Terraform 0.12 and later, are
+// supported.
+func ReadOutputs(r io.Reader) (*OutputsState, error) {
+	dec := json.NewDecoder(r)
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, errors.New("state is not a JSON object")
+	}
+
+	state := &OutputsState{Outputs: json.RawMessage("{}"), Resources: []struct{}{}}
+	fields := map[string]interface{}{
+		"version":           &state.Version,
+		"terraform_version": &state.TerraformVersion,
+		"serial":            &state.Serial,
+		"lineage":           &state.Lineage,
+		"outputs":           &state.Outputs,
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := t.(string)
+		field, ok := fields[key]
+		if !ok {
+			if err := skipValue(dec); err != nil {
+				return nil, fmt.Errorf("invalid state field %q: %v", key, err)
+			}
+			continue
+		}
+		if err := dec.Decode(field); err != nil {
+			return nil, fmt.Errorf("invalid state field %q: %v", key, err)
+		}
+	}
+	if state.Version != 4 {
+		return nil, fmt.Errorf("unsupported state version %d", state.Version)
+	}
+	return state, nil
+}
+
+// skipValue reads the next JSON value from dec without holding it in memory.
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2019 Jimmi Dyson
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package tfstate parses the parts of Terraform state files that the backend needs to know about.
+package tfstate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Header holds the top-level metadata of a Terraform state.
+type Header struct {
+	// Version is the version of the state file format.
+	Version int `json:"version"`
+	// TerraformVersion is the version of Terraform that wrote the state.
+	TerraformVersion string `json:"terraform_version"`
+	// Serial is incremented on every change to the state.
+	Serial uint64 `json:"serial"`
+	// Lineage is a unique ID assigned to a state when it is created.
+	Lineage string `json:"lineage"`
+}
+
+// ReadHeader reads the header of a Terraform state. The header fields are at the start of states written by
+// Terraform, so reading stops as soon as all header fields have been read: r can be a prefix of the state.
+func ReadHeader(r io.Reader) (*Header, error) {
+	dec := json.NewDecoder(r)
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, errors.New("state is not a JSON object")
+	}
+
+	header := &Header{}
+	fields := map[string]interface{}{
+		"version":           &header.Version,
+		"terraform_version": &header.TerraformVersion,
+		"serial":            &header.Serial,
+		"lineage":           &header.Lineage,
+	}
+	for len(fields) > 0 && dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := t.(string)
+		field, ok := fields[key]
+		if !ok {
+			var skipped json.RawMessage
+			field = &skipped
+		}
+		if err := dec.Decode(field); err != nil {
+			return nil, fmt.Errorf("invalid state field %q: %v", key, err)
+		}
+		delete(fields, key)
+	}
+	return header, nil
+}